@@ -1,11 +1,8 @@
 package main
 
 import (
-	"bufio"
-	"fmt"
+	"log"
 	"net/http"
-	"os"
-	"strings"
 
 	"github.com/cat-turner/proxy/proxy"
 )
@@ -17,46 +14,20 @@ func main() {
 	pc := proxy.NewProxyCache(configs)
 
 	if configs.Mode == "2" {
-		// Special mode that allows you to interact with the proxy through the cli
-		fmt.Println("RESPY>")
-
-		scanner := bufio.NewScanner(os.Stdin)
-		for scanner.Scan() {
-			input := scanner.Text()
-			fmt.Println(input)
-			keyInput := strings.Split(input, " ")
-			if string(keyInput[0]) != "GET" {
-				fmt.Println("Only GET is supported")
-
-			} else {
-				value, err := pc.HandleGet(string(keyInput[1]))
-				if err != nil {
-					fmt.Println(err)
-				}
-				if value == nil {
-					fmt.Println("(nil)")
-				} else {
-					fmt.Println(*value)
-				}
-
-			}
-
+		// Special mode that lets any redis client talk to the proxy
+		pipelineLimit := 0
+		if configs.RespPipelineLimit != nil {
+			pipelineLimit = *configs.RespPipelineLimit
 		}
-
-		if scanner.Err() != nil {
-			fmt.Println(scanner.Err())
-			return
-		}
-
+		server := proxy.NewRESPServer(pc, pipelineLimit)
+		log.Fatal(server.ListenAndServe(configs.RespPort))
 	}
 
-	mux := http.NewServeMux()
-
+	// the limit is shared by every route
+	handler := pc.ServeHTTP
 	if configs.ProxyClientLimit != nil {
-		mux.HandleFunc("/", proxy.LimitNumClients(pc.PayloadHandler, *configs.ProxyClientLimit))
-	} else {
-		mux.HandleFunc("/", pc.PayloadHandler)
+		handler = proxy.LimitNumClients(handler, *configs.ProxyClientLimit)
 	}
 
-	http.ListenAndServe(configs.Port, mux)
+	http.ListenAndServe(configs.Port, http.HandlerFunc(handler))
 }
@@ -1,8 +1,51 @@
 package proxy
 
+import (
+	"context"
+	"time"
+)
+
 // Cache is an interface that is not the in-memory cache used by the proxy
-// also known as the external cache, like redis
+// also known as the external cache, like redis. Every call takes the context
+// of the request it is made for, so cancellation and deadlines reach the
+// external cache.
 type Cache interface {
-	Put(key string, value string) error
-	Get(key string) (*string, error)
+	// Put stores the value for ttl, zero means the cache's default
+	Put(ctx context.Context, key string, value string, ttl time.Duration) error
+	Get(ctx context.Context, key string) (*string, error)
+	// MGet gets many keys along with the time each has left in the cache,
+	// in the order of keys. Keys the cache does not have are nil.
+	MGet(ctx context.Context, keys []string) ([]*Item, error)
+	// MSet stores values[i] for keys[i] like Put, all of them at once when
+	// atomic is set. It returns the error for each key, nil if it was stored.
+	MSet(ctx context.Context, keys []string, values []string, ttl time.Duration, atomic bool) []error
+	// Delete removes the key and reports whether it was there
+	Delete(ctx context.Context, key string) (bool, error)
+	// MDelete removes many keys like Delete, in a single round trip. It
+	// reports for each key whether it was there.
+	MDelete(ctx context.Context, keys []string) ([]bool, error)
+	// Exists reports whether the cache has the key
+	Exists(ctx context.Context, key string) (bool, error)
+	// TTL returns the time the key has left, zero if it does not expire,
+	// and false if the cache does not have the key
+	TTL(ctx context.Context, key string) (time.Duration, bool, error)
+}
+
+// Item is a value read from the external cache
+type Item struct {
+	Value string
+	// TTL is the time the key has left, zero if it does not expire
+	TTL time.Duration
+}
+
+// PubSub is implemented by external caches that can pass messages between
+// proxy instances, like redis
+type PubSub interface {
+	Publish(ctx context.Context, channel string, message string) error
+	// Subscribe calls handle with every message sent on channel until the
+	// returned function is called
+	Subscribe(channel string, handle func(message string)) (func() error, error)
+	// PSubscribe is like Subscribe for every channel matching pattern,
+	// handle also gets the channel the message was sent on
+	PSubscribe(pattern string, handle func(channel string, message string)) (func() error, error)
 }
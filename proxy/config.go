@@ -5,18 +5,34 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
 // Config is a struct to hold configuration values.
 type Config struct {
-	RedisUrl         string
-	RedisTTL         *time.Duration
-	Port             string
-	CacheKeyCapacity *int
-	CacheTTL         *time.Duration
-	ProxyClientLimit *int
-	Mode             string
+	Backend           string
+	RedisUrl          string
+	RedisClusterNodes []string
+	MemcachedUrl      string
+	RedisTTL          *time.Duration
+	Port              string
+	KeyPathPrefix     string
+	RespPort          string
+	// RespPipelineLimit caps the commands a RESP client can have in flight
+	RespPipelineLimit *int
+	CacheKeyCapacity  *int
+	CacheTTL          *time.Duration
+	// EvictionPolicy names the policy used once CacheKeyCapacity is reached
+	EvictionPolicy        string
+	CacheAdmission        string
+	CacheShards           *int
+	InvalidationChannel   string
+	KeyspaceNotifications bool
+	RedisTracking         string
+	RedisTrackingPrefixes []string
+	ProxyClientLimit      *int
+	Mode                  string
 }
 
 func (c Config) getEnv(key string, defaultValue string) string {
@@ -31,12 +47,38 @@ func (c Config) getEnv(key string, defaultValue string) string {
 // vars or setting them to defaul values, if applicable
 func NewConfig() Config {
 	c := Config{}
-	c.RedisUrl = c.getEnv("REDIS_URL", "localhost:6379")
 	log.Print("Importing Env Variables...")
+	// external cache
+	// redis - a redis server at REDIS_URL
+	// memcached - a memcached server at MEMCACHED_URL
+	// memory - kept in the proxy's own memory, for running without redis
+	c.Backend = c.getEnv("BACKEND", "redis")
+	switch c.Backend {
+	case "redis", "memcached", "memory":
+		log.Print(fmt.Sprintf("BACKEND: %v", c.Backend))
+	default:
+		log.Fatal(fmt.Sprintf("unknown BACKEND %q", c.Backend))
+	}
+	c.RedisUrl = c.getEnv("REDIS_URL", "localhost:6379")
 	log.Print(fmt.Sprintf("REDIS_URL: %v", c.RedisUrl))
+	// a Redis Cluster is used instead of REDIS_URL when some of its nodes
+	// are given
+	rcn := c.getEnv("REDIS_CLUSTER_NODES", "")
+	if rcn != "" {
+		c.RedisClusterNodes = strings.Split(rcn, ",")
+		log.Print(fmt.Sprintf("REDIS_CLUSTER_NODES: %v", c.RedisClusterNodes))
+	}
+	c.MemcachedUrl = c.getEnv("MEMCACHED_URL", "localhost:11211")
+	if c.Backend == "memcached" {
+		log.Print(fmt.Sprintf("MEMCACHED_URL: %v", c.MemcachedUrl))
+	}
 	port := c.getEnv("PORT", "8080")
 	c.Port = fmt.Sprintf(":%v", port)
 	log.Print(fmt.Sprintf("Port: %v", c.Port))
+	c.KeyPathPrefix = c.getEnv("KEY_PATH_PREFIX", "")
+	if c.KeyPathPrefix != "" {
+		log.Print(fmt.Sprintf("KEY_PATH_PREFIX: %v", c.KeyPathPrefix))
+	}
 	ckp := c.getEnv("CACHE_KEY_CAPACITY", "")
 	if ckp != "" {
 		x, err := strconv.ParseInt(ckp, 10, 64)
@@ -59,6 +101,60 @@ func NewConfig() Config {
 			log.Print(fmt.Sprintf("CACHE_TTL: %v", ct))
 		}
 	}
+	c.EvictionPolicy = c.getEnv("CACHE_EVICTION_POLICY", "lru")
+	if _, err := NewEvictionPolicy(c.EvictionPolicy); err != nil {
+		log.Fatal(err)
+	}
+	log.Print(fmt.Sprintf("CACHE_EVICTION_POLICY: %v", c.EvictionPolicy))
+	c.CacheAdmission = c.getEnv("CACHE_ADMISSION", "")
+	if c.CacheAdmission != "" {
+		if _, err := NewAdmissionPolicy(c.CacheAdmission, nil, 0); err != nil {
+			log.Fatal(err)
+		}
+		log.Print(fmt.Sprintf("CACHE_ADMISSION: %v", c.CacheAdmission))
+	}
+	cs := c.getEnv("CACHE_SHARDS", "")
+	if cs != "" {
+		x, err := strconv.ParseInt(cs, 10, 64)
+		if err != nil {
+			log.Fatal(err)
+		} else {
+			xc := int(x)
+			c.CacheShards = &xc
+			log.Print(fmt.Sprintf("CACHE_SHARDS: %v", xc))
+		}
+	}
+	c.InvalidationChannel = c.getEnv("CACHE_INVALIDATION_CHANNEL", "")
+	if c.InvalidationChannel != "" {
+		log.Print(fmt.Sprintf("CACHE_INVALIDATION_CHANNEL: %v", c.InvalidationChannel))
+	}
+	ksn := c.getEnv("CACHE_KEYSPACE_NOTIFICATIONS", "")
+	if ksn != "" {
+		k, err := strconv.ParseBool(ksn)
+		if err != nil {
+			log.Fatal(err)
+		} else {
+			c.KeyspaceNotifications = k
+			log.Print(fmt.Sprintf("CACHE_KEYSPACE_NOTIFICATIONS: %v", k))
+		}
+	}
+	// client side caching
+	// "" - off
+	// default - redis tracks the keys the proxy reads
+	// bcast - redis reports every key matching REDIS_TRACKING_PREFIXES
+	c.RedisTracking = c.getEnv("REDIS_TRACKING", "")
+	switch c.RedisTracking {
+	case "":
+	case "default", "bcast":
+		log.Print(fmt.Sprintf("REDIS_TRACKING: %v", c.RedisTracking))
+	default:
+		log.Fatal(fmt.Sprintf("unknown REDIS_TRACKING %q", c.RedisTracking))
+	}
+	rtp := c.getEnv("REDIS_TRACKING_PREFIXES", "")
+	if rtp != "" {
+		c.RedisTrackingPrefixes = strings.Split(rtp, ",")
+		log.Print(fmt.Sprintf("REDIS_TRACKING_PREFIXES: %v", c.RedisTrackingPrefixes))
+	}
 	rttl := c.getEnv("REDIS_TTL", "")
 	if rttl != "" {
 		rt, err := time.ParseDuration(rttl + "s")
@@ -82,6 +178,21 @@ func NewConfig() Config {
 	// 1 or "" - http
 	// 2 is RESP
 	c.Mode = c.getEnv("APP_MODE", "")
+	respPort := c.getEnv("RESP_PORT", "6380")
+	c.RespPort = fmt.Sprintf(":%v", respPort)
+	if c.Mode == "2" {
+		log.Print(fmt.Sprintf("RESP_PORT: %v", c.RespPort))
+	}
+	rpl := c.getEnv("RESP_PIPELINE_LIMIT", "")
+	if rpl != "" {
+		l, err := strconv.ParseInt(rpl, 10, 64)
+		if err != nil {
+			log.Fatal(err)
+		} else {
+			lc := int(l)
+			c.RespPipelineLimit = &lc
+		}
+	}
 
 	return c
 }
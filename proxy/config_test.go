@@ -12,27 +12,51 @@ func TestConfiguration(t *testing.T) {
 	assert := assert.New(t)
 	// verify that config are defined by the environment, if it is defined
 	// in the environment
+	os.Setenv("BACKEND", "memcached")
 	os.Setenv("REDIS_URL", "1")
+	os.Setenv("REDIS_CLUSTER_NODES", "a:1,b:2")
+	os.Setenv("MEMCACHED_URL", "2")
 	os.Setenv("REDIS_TTL", "3")
 	os.Setenv("PORT", "3")
+	os.Setenv("KEY_PATH_PREFIX", "/cache")
 	os.Setenv("CACHE_KEY_CAPACITY", "4")
 	os.Setenv("CACHE_TTL", "5")
 	os.Setenv("PROXY_CLIENT_LIMIT", "6")
+	os.Setenv("CACHE_EVICTION_POLICY", "lfu")
+	os.Setenv("CACHE_SHARDS", "7")
+	os.Setenv("CACHE_INVALIDATION_CHANNEL", "invalidations")
+	os.Setenv("CACHE_KEYSPACE_NOTIFICATIONS", "true")
 
 	e1, _ := time.ParseDuration("3s")
 	e2, _ := time.ParseDuration("5s")
 	config := NewConfig()
+	assert.Equal("memcached", config.Backend)
 	assert.Equal("1", config.RedisUrl)
+	assert.Equal([]string{"a:1", "b:2"}, config.RedisClusterNodes)
+	assert.Equal("2", config.MemcachedUrl)
 	assert.Equal(e1, *config.RedisTTL)
 	assert.Equal(":3", config.Port)
+	assert.Equal("/cache", config.KeyPathPrefix)
 	assert.Equal(4, *config.CacheKeyCapacity)
 	assert.Equal(e2, *config.CacheTTL)
 	assert.Equal(6, *config.ProxyClientLimit)
+	assert.Equal("lfu", config.EvictionPolicy)
+	assert.Equal(7, *config.CacheShards)
+	assert.Equal("invalidations", config.InvalidationChannel)
+	assert.True(config.KeyspaceNotifications)
 
+	os.Unsetenv("BACKEND")
 	os.Unsetenv("REDIS_URL")
+	os.Unsetenv("REDIS_CLUSTER_NODES")
+	os.Unsetenv("MEMCACHED_URL")
 	os.Unsetenv("REDIS_TTL")
 	os.Unsetenv("PORT")
+	os.Unsetenv("KEY_PATH_PREFIX")
 	os.Unsetenv("CACHE_KEY_CAPACITY")
 	os.Unsetenv("CACHE_TTL")
 	os.Unsetenv("PROXY_CLIENT_LIMIT")
+	os.Unsetenv("CACHE_EVICTION_POLICY")
+	os.Unsetenv("CACHE_SHARDS")
+	os.Unsetenv("CACHE_INVALIDATION_CHANNEL")
+	os.Unsetenv("CACHE_KEYSPACE_NOTIFICATIONS")
 }
@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/crc32"
+	"strings"
+)
+
+// contentTypeSuffix names the key that keeps the content type of a value next
+// to it in the external cache, like users/42:content-type for users/42. The
+// value itself is stored as it is, so other readers of the external cache see
+// it unchanged.
+const contentTypeSuffix = ":content-type"
+
+func contentTypeKey(key string) string {
+	return key + contentTypeSuffix
+}
+
+// encodeContentType returns what to store under the content type key of
+// value. It starts with a checksum of the value, so a content type that was
+// left behind when something replaced the value is not taken for the new one.
+func encodeContentType(value ValueStore) string {
+	return fmt.Sprintf("%08x %s", crc32.ChecksumIEEE([]byte(value.Value)), value.ContentType)
+}
+
+// decodeContentType returns the content type in stored, which was read from
+// the content type key of value. It is empty unless stored was written for
+// this value.
+func decodeContentType(value string, stored string) string {
+	sum := fmt.Sprintf("%08x ", crc32.ChecksumIEEE([]byte(value)))
+	if !strings.HasPrefix(stored, sum) {
+		return ""
+	}
+	return stored[len(sum):]
+}
@@ -0,0 +1,218 @@
+package proxy
+
+import (
+	"container/list"
+	"fmt"
+	"math/rand"
+)
+
+// EvictionPolicy decides which key the proxy cache evicts once it holds
+// MaxKeys keys. ProxyCache tells the policy about every key it reads, inserts
+// and removes, and asks it for a victim when it needs room.
+//
+// Policies are not safe for concurrent use, ProxyCache only calls them while
+// holding its lock.
+type EvictionPolicy interface {
+	// Access records a read or an overwrite of a key that is in the cache
+	Access(key string)
+	// Insert records a key that was added to the cache
+	Insert(key string)
+	// Remove forgets a key that left the cache
+	Remove(key string)
+	// Victim returns the key to evict next, false means the policy does
+	// not know of any keys
+	Victim() (string, bool)
+}
+
+// NewEvictionPolicy returns the policy with the given name, which is one of
+// lru, lfu, fifo or random. An empty name gives lru.
+func NewEvictionPolicy(name string) (EvictionPolicy, error) {
+	switch name {
+	case "", "lru":
+		return newLRUPolicy(), nil
+	case "lfu":
+		return newLFUPolicy(), nil
+	case "fifo":
+		return newFIFOPolicy(), nil
+	case "random":
+		return newRandomPolicy(), nil
+	}
+	return nil, fmt.Errorf("unknown eviction policy %q", name)
+}
+
+// lruPolicy evicts the least recently used key. Keys are kept in a list from
+// most to least recently used so every operation is O(1).
+type lruPolicy struct {
+	order    *list.List
+	elements map[string]*list.Element
+}
+
+func newLRUPolicy() *lruPolicy {
+	return &lruPolicy{
+		order:    list.New(),
+		elements: make(map[string]*list.Element),
+	}
+}
+
+func (p *lruPolicy) Access(key string) {
+	if e, ok := p.elements[key]; ok {
+		p.order.MoveToFront(e)
+	}
+}
+
+func (p *lruPolicy) Insert(key string) {
+	if e, ok := p.elements[key]; ok {
+		p.order.MoveToFront(e)
+		return
+	}
+	p.elements[key] = p.order.PushFront(key)
+}
+
+func (p *lruPolicy) Remove(key string) {
+	if e, ok := p.elements[key]; ok {
+		p.order.Remove(e)
+		delete(p.elements, key)
+	}
+}
+
+func (p *lruPolicy) Victim() (string, bool) {
+	e := p.order.Back()
+	if e == nil {
+		return "", false
+	}
+	return e.Value.(string), true
+}
+
+// fifoPolicy evicts the key that was inserted first, reads do not matter
+type fifoPolicy struct {
+	lruPolicy
+}
+
+func newFIFOPolicy() *fifoPolicy {
+	return &fifoPolicy{lruPolicy: *newLRUPolicy()}
+}
+
+func (p *fifoPolicy) Access(key string) {}
+
+// lfuPolicy evicts the least frequently used key, and the least recently
+// used one of those when there is a tie.
+//
+// Keys with the same count share a bucket and the buckets are kept in a list
+// sorted by count, so a key only ever moves to the next bucket and every
+// operation is O(1).
+type lfuPolicy struct {
+	buckets *list.List
+	entries map[string]*lfuEntry
+}
+
+type lfuBucket struct {
+	count int
+	keys  *list.List
+}
+
+type lfuEntry struct {
+	bucket *list.Element
+	elem   *list.Element
+}
+
+func newLFUPolicy() *lfuPolicy {
+	return &lfuPolicy{
+		buckets: list.New(),
+		entries: make(map[string]*lfuEntry),
+	}
+}
+
+func (p *lfuPolicy) Access(key string) {
+	e, ok := p.entries[key]
+	if !ok {
+		return
+	}
+	current := e.bucket.Value.(*lfuBucket)
+	next := e.bucket.Next()
+	if next == nil || next.Value.(*lfuBucket).count != current.count+1 {
+		next = p.buckets.InsertAfter(&lfuBucket{count: current.count + 1, keys: list.New()}, e.bucket)
+	}
+	p.unlink(e)
+	e.bucket = next
+	e.elem = next.Value.(*lfuBucket).keys.PushFront(key)
+}
+
+func (p *lfuPolicy) Insert(key string) {
+	if _, ok := p.entries[key]; ok {
+		p.Access(key)
+		return
+	}
+	first := p.buckets.Front()
+	if first == nil || first.Value.(*lfuBucket).count != 1 {
+		first = p.buckets.PushFront(&lfuBucket{count: 1, keys: list.New()})
+	}
+	p.entries[key] = &lfuEntry{
+		bucket: first,
+		elem:   first.Value.(*lfuBucket).keys.PushFront(key),
+	}
+}
+
+func (p *lfuPolicy) Remove(key string) {
+	if e, ok := p.entries[key]; ok {
+		p.unlink(e)
+		delete(p.entries, key)
+	}
+}
+
+func (p *lfuPolicy) Victim() (string, bool) {
+	first := p.buckets.Front()
+	if first == nil {
+		return "", false
+	}
+	return first.Value.(*lfuBucket).keys.Back().Value.(string), true
+}
+
+// unlink takes the entry out of its bucket and drops the bucket once it is empty
+func (p *lfuPolicy) unlink(e *lfuEntry) {
+	b := e.bucket.Value.(*lfuBucket)
+	b.keys.Remove(e.elem)
+	if b.keys.Len() == 0 {
+		p.buckets.Remove(e.bucket)
+	}
+}
+
+// randomPolicy evicts a key chosen at random, which costs nothing to keep up
+// to date and does well when there is no pattern to the reads
+type randomPolicy struct {
+	keys    []string
+	indexes map[string]int
+}
+
+func newRandomPolicy() *randomPolicy {
+	return &randomPolicy{indexes: make(map[string]int)}
+}
+
+func (p *randomPolicy) Access(key string) {}
+
+func (p *randomPolicy) Insert(key string) {
+	if _, ok := p.indexes[key]; ok {
+		return
+	}
+	p.indexes[key] = len(p.keys)
+	p.keys = append(p.keys, key)
+}
+
+func (p *randomPolicy) Remove(key string) {
+	i, ok := p.indexes[key]
+	if !ok {
+		return
+	}
+	// move the last key into the hole so the slice stays dense
+	last := p.keys[len(p.keys)-1]
+	p.keys[i] = last
+	p.indexes[last] = i
+	p.keys = p.keys[:len(p.keys)-1]
+	delete(p.indexes, key)
+}
+
+func (p *randomPolicy) Victim() (string, bool) {
+	if len(p.keys) == 0 {
+		return "", false
+	}
+	return p.keys[rand.Intn(len(p.keys))], true
+}
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"testing"
+
+	assert "github.com/stretchr/testify/assert"
+)
+
+func TestNewEvictionPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, name := range []string{"", "lru", "lfu", "fifo", "random"} {
+		p, err := NewEvictionPolicy(name)
+		assert.NoError(err)
+		assert.NotNil(p)
+	}
+
+	_, err := NewEvictionPolicy("mru")
+	assert.EqualError(err, `unknown eviction policy "mru"`)
+}
+
+func TestLRUPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	p := newLRUPolicy()
+	_, ok := p.Victim()
+	assert.False(ok)
+
+	p.Insert("rocco")
+	p.Insert("heff")
+	p.Insert("tito")
+	p.Access("rocco")
+
+	victim, ok := p.Victim()
+	assert.True(ok)
+	assert.Equal("heff", victim)
+
+	p.Remove("heff")
+	victim, _ = p.Victim()
+	assert.Equal("tito", victim)
+}
+
+func TestFIFOPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	p := newFIFOPolicy()
+	p.Insert("rocco")
+	p.Insert("heff")
+	p.Access("rocco")
+
+	// reads do not change the order keys leave in
+	victim, _ := p.Victim()
+	assert.Equal("rocco", victim)
+
+	p.Remove("rocco")
+	victim, _ = p.Victim()
+	assert.Equal("heff", victim)
+}
+
+func TestLFUPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	p := newLFUPolicy()
+	p.Insert("rocco")
+	p.Insert("heff")
+	p.Insert("tito")
+	p.Access("rocco")
+	p.Access("rocco")
+	p.Access("tito")
+
+	victim, _ := p.Victim()
+	assert.Equal("heff", victim)
+	p.Remove("heff")
+
+	// tito and the new key roxi tie with rocco out in front
+	p.Insert("roxi")
+	p.Access("roxi")
+	victim, _ = p.Victim()
+	assert.Equal("tito", victim)
+	p.Remove("tito")
+
+	victim, _ = p.Victim()
+	assert.Equal("roxi", victim)
+	p.Remove("roxi")
+
+	victim, _ = p.Victim()
+	assert.Equal("rocco", victim)
+	p.Remove("rocco")
+
+	_, ok := p.Victim()
+	assert.False(ok)
+	assert.Equal(0, p.buckets.Len())
+}
+
+func TestRandomPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	p := newRandomPolicy()
+	p.Insert("rocco")
+	p.Insert("heff")
+	p.Insert("tito")
+	p.Remove("rocco")
+
+	for i := 0; i < 20; i++ {
+		victim, ok := p.Victim()
+		assert.True(ok)
+		assert.Contains([]string{"heff", "tito"}, victim)
+	}
+
+	p.Remove("heff")
+	p.Remove("tito")
+	_, ok := p.Victim()
+	assert.False(ok)
+}
+
+func TestProxyCacheEvictionPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	only2 := 2
+	proxy := newLocalCache(Config{CacheKeyCapacity: &only2, EvictionPolicy: "lfu"})
+	t.Cleanup(proxy.Close)
+
+	proxy.Put("rocco", "wow")
+	proxy.Put("heff", "zao")
+	proxy.Get("rocco")
+	proxy.Get("heff")
+	proxy.Get("heff")
+
+	// rocco was read more recently but heff was read more often
+	proxy.Put("tito", "pow")
+	assert.Nil(proxy.Get("rocco"))
+	assert.Equal("zao", *proxy.Get("heff"))
+	assert.Equal("pow", *proxy.Get("tito"))
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"container/heap"
+	"time"
+)
+
+// expiryQueue is a min-heap of keys ordered by when they expire, so finding
+// the keys that are due only touches those keys
+type expiryQueue struct {
+	items expiryHeap
+	index map[string]*expiryItem
+}
+
+type expiryItem struct {
+	key string
+	at  time.Time
+	pos int
+}
+
+func newExpiryQueue() *expiryQueue {
+	return &expiryQueue{index: make(map[string]*expiryItem)}
+}
+
+// Schedule sets when key expires, replacing any earlier schedule. It returns
+// true when key is now the first key to expire.
+func (q *expiryQueue) Schedule(key string, at time.Time) bool {
+	if item, ok := q.index[key]; ok {
+		item.at = at
+		heap.Fix(&q.items, item.pos)
+	} else {
+		item = &expiryItem{key: key, at: at}
+		q.index[key] = item
+		heap.Push(&q.items, item)
+	}
+	return q.items[0].key == key
+}
+
+// Unschedule forgets key
+func (q *expiryQueue) Unschedule(key string) {
+	if item, ok := q.index[key]; ok {
+		heap.Remove(&q.items, item.pos)
+		delete(q.index, key)
+	}
+}
+
+// Next returns when the first key expires, false if nothing is scheduled
+func (q *expiryQueue) Next() (time.Time, bool) {
+	if len(q.items) == 0 {
+		return time.Time{}, false
+	}
+	return q.items[0].at, true
+}
+
+// PopDue removes and returns the keys that expire at or before now
+func (q *expiryQueue) PopDue(now time.Time) []string {
+	var due []string
+	for len(q.items) > 0 && !q.items[0].at.After(now) {
+		item := heap.Pop(&q.items).(*expiryItem)
+		delete(q.index, item.key)
+		due = append(due, item.key)
+	}
+	return due
+}
+
+// Len returns the number of keys scheduled to expire
+func (q *expiryQueue) Len() int {
+	return len(q.items)
+}
+
+// expiryHeap implements heap.Interface
+type expiryHeap []*expiryItem
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].pos = i
+	h[j].pos = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	item := x.(*expiryItem)
+	item.pos = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return item
+}
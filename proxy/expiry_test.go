@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/assert"
+)
+
+func TestExpiryQueue(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	q := newExpiryQueue()
+	assert.True(q.Schedule("tita", now.Add(3*time.Second)))
+	assert.True(q.Schedule("roxi", now.Add(time.Second)))
+	assert.False(q.Schedule("heff", now.Add(2*time.Second)))
+
+	next, ok := q.Next()
+	assert.True(ok)
+	assert.Equal(now.Add(time.Second), next)
+
+	// moving a key to the front or dropping it changes what is due first
+	assert.True(q.Schedule("tita", now))
+	q.Unschedule("roxi")
+	assert.Equal([]string{"tita"}, q.PopDue(now))
+	assert.Empty(q.PopDue(now.Add(time.Second)))
+	assert.Equal([]string{"heff"}, q.PopDue(now.Add(2*time.Second)))
+
+	_, ok = q.Next()
+	assert.False(ok)
+	assert.Equal(0, q.Len())
+}
+
+func TestExpireKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	ttl := 50 * time.Millisecond
+	proxy := newLocalCache(Config{CacheTTL: &ttl})
+	defer proxy.Close()
+
+	proxy.Put("roxi", "rocks")
+	proxy.Put("tita", "is cool")
+	time.Sleep(ttl / 2)
+	proxy.Put("tita", "is fire")
+
+	// only roxi is due, the rewrite pushed tita back
+	time.Sleep(ttl/2 + 20*time.Millisecond)
+	assert.Equal(1, proxy.Len())
+	assert.Equal("is fire", *proxy.Get("tita"))
+
+	time.Sleep(ttl)
+	assert.Equal(0, proxy.Len())
+}
+
+func TestGetSkipsExpiredKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	ttl := time.Minute
+	proxy := newLocalCache(Config{CacheTTL: &ttl})
+	// without the go routine keys are only ever expired lazily
+	proxy.Close()
+
+	proxy.Put("roxi", "rocks")
+	s := proxy.shard("roxi")
+	s.mux.Lock()
+	v := s.data["roxi"]
+	v.ExpiryTime = time.Now().Add(-time.Second)
+	s.data["roxi"] = v
+	s.mux.Unlock()
+
+	assert.Nil(proxy.Get("roxi"))
+	assert.Equal(0, proxy.Len())
+}
+
+func TestNoKeyTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	// a zero timeout means keys never expire, rather than right away
+	proxy := newLocalCache(Config{})
+	defer proxy.Close()
+
+	proxy.Put("roxi", "rocks")
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal("rocks", *proxy.Get("roxi"))
+	assert.Equal(0, proxy.shard("roxi").expiries.Len())
+}
+
+func TestPutWithTTL(t *testing.T) {
+	assert := assert.New(t)
+
+	ttl := time.Minute
+	proxy := newLocalCache(Config{CacheTTL: &ttl})
+	defer proxy.Close()
+
+	// the shorter of the two wins
+	proxy.PutWithTTL("roxi", "rocks", time.Second)
+	proxy.PutWithTTL("tita", "is cool", time.Hour)
+	proxy.PutWithTTL("heff", "zao", 0)
+
+	roxi, _ := proxy.Peek("roxi")
+	tita, _ := proxy.Peek("tita")
+	heff, _ := proxy.Peek("heff")
+	assert.WithinDuration(time.Now().Add(time.Second), roxi.ExpiryTime, 100*time.Millisecond)
+	assert.WithinDuration(time.Now().Add(time.Minute), tita.ExpiryTime, 100*time.Millisecond)
+	assert.WithinDuration(time.Now().Add(time.Minute), heff.ExpiryTime, 100*time.Millisecond)
+
+	// without a CACHE_TTL only the given ttl counts
+	noTimeout := newLocalCache(Config{})
+	defer noTimeout.Close()
+	noTimeout.PutWithTTL("roxi", "rocks", time.Second)
+	noTimeout.PutWithTTL("tita", "is cool", 0)
+	roxi, _ = noTimeout.Peek("roxi")
+	tita, _ = noTimeout.Peek("tita")
+	assert.WithinDuration(time.Now().Add(time.Second), roxi.ExpiryTime, 100*time.Millisecond)
+	assert.True(tita.ExpiryTime.IsZero())
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// invalidation is the message a proxy sends to the others when it changes
+// keys, so they drop their local copy
+type invalidation struct {
+	// Origin is the id of the proxy that changed the key, it already has
+	// the new value so it ignores its own messages
+	Origin string `json:"origin"`
+	Key    string `json:"key,omitempty"`
+	// Keys are the keys a batch changed, in a single message
+	Keys []string `json:"keys,omitempty"`
+}
+
+// newProxyID returns a random id that tells proxy instances apart
+func newProxyID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatal(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// subscribeInvalidations drops keys from the local cache when another proxy
+// tells us on channel that it changed them
+func (c *ProxyCache) subscribeInvalidations(ps PubSub, channel string) error {
+	unsubscribe, err := ps.Subscribe(channel, func(message string) {
+		var inv invalidation
+		if err := json.Unmarshal([]byte(message), &inv); err != nil {
+			log.Print(fmt.Sprintf("bad invalidation %q: %v", message, err))
+			return
+		}
+		if inv.Origin == c.id {
+			return
+		}
+		if inv.Key != "" {
+			c.Invalidate(inv.Key)
+		}
+		for _, key := range inv.Keys {
+			c.Invalidate(key)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	c.pubsub = ps
+	c.invalidationChannel = channel
+	c.unsubscribe = append(c.unsubscribe, unsubscribe)
+	return nil
+}
+
+// keyspacePrefix is the start of the channels redis sends keyspace
+// notifications for database 0 on, the rest of the channel is the key
+const keyspacePrefix = "__keyspace@0__:"
+
+// subscribeKeyspace drops keys from the local cache whenever redis reports
+// that something happened to them, so writes made by other services that
+// bypass the proxy invalidate it too. Redis only sends the events enabled in
+// its notify-keyspace-events setting.
+func (c *ProxyCache) subscribeKeyspace(ps PubSub) error {
+	unsubscribe, err := ps.PSubscribe(keyspacePrefix+"*", func(channel string, event string) {
+		// every event, like set, del, expired or rename, means our copy
+		// may no longer be what redis has
+		c.Invalidate(strings.TrimPrefix(channel, keyspacePrefix))
+	})
+	if err != nil {
+		return err
+	}
+	c.unsubscribe = append(c.unsubscribe, unsubscribe)
+	return nil
+}
+
+// publishInvalidation tells the other proxies that keys changed, in one
+// message however many there are. The change is already in the external
+// cache, so failing to publish is only logged: the other proxies still pick
+// it up once their copy expires.
+func (c *ProxyCache) publishInvalidation(ctx context.Context, keys ...string) {
+	if c.pubsub == nil || len(keys) == 0 {
+		return
+	}
+	inv := invalidation{Origin: c.id}
+	if len(keys) == 1 {
+		inv.Key = keys[0]
+	} else {
+		inv.Keys = keys
+	}
+	message, err := json.Marshal(inv)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	if err := c.pubsub.Publish(ctx, c.invalidationChannel, string(message)); err != nil {
+		log.Print(err)
+	}
+}
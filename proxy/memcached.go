@@ -0,0 +1,504 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// memcachedMaxIdle is the number of idle connections kept for reuse
+	memcachedMaxIdle = 16
+	// memcachedMaxRelativeTTL is the longest expiry memcached takes as a
+	// number of seconds, anything longer has to be sent as a unix time
+	memcachedMaxRelativeTTL = 30 * 24 * 60 * 60
+	// memcachedMaxKeyLen is the longest key memcached accepts
+	memcachedMaxKeyLen = 250
+	// memcachedTimeout is how long a round trip may take when the request
+	// has no deadline of its own
+	memcachedTimeout = 5 * time.Second
+)
+
+// errMemcachedAtomic is returned by MSet when asked to store keys atomically,
+// memcached can only store them one at a time
+var errMemcachedAtomic = errors.New("memcached can not store keys atomically")
+
+// memcachedError is an error reply from memcached, the connection can still
+// be used after one
+type memcachedError string
+
+func (e memcachedError) Error() string {
+	return "memcached: " + string(e)
+}
+
+// MemcachedClient is an external cache that talks to memcached with its text
+// protocol. Values are read with the meta get command (mg), which returns
+// the time a key has left, so it needs memcached 1.6 or later. Memcached can
+// not pass messages, so proxies in front of it can not invalidate each other.
+type MemcachedClient struct {
+	Addr       string
+	KeyTimeout time.Duration
+	// Timeout limits round trips of requests without a deadline, so a
+	// stalled memcached does not hang them, memcachedTimeout when zero
+	Timeout time.Duration
+
+	mux  sync.Mutex
+	idle []*memcachedConn
+}
+
+type memcachedConn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+// NewMemcachedClient creates new memcached client, it fails when memcached
+// can not be reached
+func NewMemcachedClient(keyTimeout *time.Duration, memcachedUrl string) (*MemcachedClient, error) {
+	mc := &MemcachedClient{Addr: memcachedUrl}
+	if keyTimeout != nil {
+		mc.KeyTimeout = *keyTimeout
+	}
+	err := mc.do(context.Background(), func(cn *memcachedConn) error {
+		cn.w.WriteString("version\r\n")
+		if err := cn.w.Flush(); err != nil {
+			return err
+		}
+		line, err := cn.readLine()
+		if err == nil && !strings.HasPrefix(line, "VERSION ") {
+			err = memcachedError(line)
+		}
+		return err
+	})
+	if err != nil {
+		mc.Close()
+		return nil, err
+	}
+	return mc, nil
+}
+
+// Put stores the value for ttl, or KeyTimeout when ttl is zero
+func (mc *MemcachedClient) Put(ctx context.Context, key string, value string, ttl time.Duration) error {
+	return mc.MSet(ctx, []string{key}, []string{value}, ttl, false)[0]
+}
+
+// Get ...
+func (mc *MemcachedClient) Get(ctx context.Context, key string) (*string, error) {
+	items, err := mc.MGet(ctx, []string{key})
+	if err != nil || items[0] == nil {
+		return nil, err
+	}
+	return &items[0].Value, nil
+}
+
+// MGet gets the values of keys and the time each has left, the commands for
+// all of them are sent in one go
+func (mc *MemcachedClient) MGet(ctx context.Context, keys []string) ([]*Item, error) {
+	items := make([]*Item, len(keys))
+	if len(keys) == 0 {
+		return items, nil
+	}
+	// a key too long for memcached can not have been stored, like the
+	// content type key of a key close to the limit, so it is a miss
+	var sent []int
+	for i, key := range keys {
+		if len(key) > memcachedMaxKeyLen {
+			continue
+		}
+		if err := checkMemcachedKey(key); err != nil {
+			return nil, err
+		}
+		sent = append(sent, i)
+	}
+	if len(sent) == 0 {
+		return items, nil
+	}
+	err := mc.do(ctx, func(cn *memcachedConn) error {
+		for _, i := range sent {
+			fmt.Fprintf(cn.w, "mg %s v t\r\n", keys[i])
+		}
+		if err := cn.w.Flush(); err != nil {
+			return err
+		}
+		// every reply is read, even after an error, so the connection
+		// can be used again
+		var firstErr error
+		for _, i := range sent {
+			item, err := cn.readItem()
+			if err != nil {
+				if _, ok := err.(memcachedError); !ok {
+					return err
+				}
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+			items[i] = item
+		}
+		return firstErr
+	})
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// MSet stores many values, the commands for all of them are sent in one go.
+// Memcached has no transactions, so when atomic is set nothing is stored.
+func (mc *MemcachedClient) MSet(ctx context.Context, keys []string, values []string, ttl time.Duration, atomic bool) []error {
+	errs := make([]error, len(keys))
+	if atomic {
+		for i := range errs {
+			errs[i] = errMemcachedAtomic
+		}
+		return errs
+	}
+	if ttl == 0 {
+		ttl = mc.KeyTimeout
+	}
+	exptime := memcachedExptime(ttl)
+
+	for i, key := range keys {
+		errs[i] = checkMemcachedKey(key)
+	}
+	// a value is not stored without the content type key next to it, which
+	// can be too long when the key itself is not
+	index := make(map[string]int, len(keys))
+	for i, key := range keys {
+		index[key] = i
+	}
+	for i, key := range keys {
+		if j, ok := index[strings.TrimSuffix(key, contentTypeSuffix)]; ok && j != i && errs[i] != nil && errs[j] == nil {
+			errs[j] = errs[i]
+		}
+	}
+	var sent []int
+	for i := range keys {
+		if errs[i] == nil {
+			sent = append(sent, i)
+		}
+	}
+	if len(sent) == 0 {
+		return errs
+	}
+	err := mc.do(ctx, func(cn *memcachedConn) error {
+		for _, i := range sent {
+			fmt.Fprintf(cn.w, "set %s 0 %d %d\r\n", keys[i], exptime, len(values[i]))
+			cn.w.WriteString(values[i])
+			cn.w.WriteString("\r\n")
+		}
+		if err := cn.w.Flush(); err != nil {
+			return err
+		}
+		for _, i := range sent {
+			line, err := cn.readLine()
+			if _, ok := err.(memcachedError); ok {
+				errs[i] = err
+				continue
+			} else if err != nil {
+				return err
+			}
+			if line != "STORED" {
+				errs[i] = memcachedError(line)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// we can not tell which of them were stored
+		for _, i := range sent {
+			errs[i] = err
+		}
+	}
+	return errs
+}
+
+// Delete removes the key, it reports false if memcached did not have it
+func (mc *MemcachedClient) Delete(ctx context.Context, key string) (bool, error) {
+	if err := checkMemcachedKey(key); err != nil {
+		return false, err
+	}
+	deleted, err := mc.MDelete(ctx, []string{key})
+	if err != nil {
+		return false, err
+	}
+	return deleted[0], nil
+}
+
+// MDelete removes many keys, the commands for all of them are sent in one go.
+// It reports false for the keys memcached did not have.
+func (mc *MemcachedClient) MDelete(ctx context.Context, keys []string) ([]bool, error) {
+	deleted := make([]bool, len(keys))
+	// like in MGet, a key too long for memcached was never there
+	var sent []int
+	for i, key := range keys {
+		if len(key) > memcachedMaxKeyLen {
+			continue
+		}
+		if err := checkMemcachedKey(key); err != nil {
+			return nil, err
+		}
+		sent = append(sent, i)
+	}
+	if len(sent) == 0 {
+		return deleted, nil
+	}
+	err := mc.do(ctx, func(cn *memcachedConn) error {
+		for _, i := range sent {
+			fmt.Fprintf(cn.w, "delete %s\r\n", keys[i])
+		}
+		if err := cn.w.Flush(); err != nil {
+			return err
+		}
+		// every reply is read, even after an error, so the connection
+		// can be used again
+		var firstErr error
+		for _, i := range sent {
+			line, err := cn.readLine()
+			if _, ok := err.(memcachedError); !ok && err != nil {
+				return err
+			}
+			switch {
+			case err != nil:
+			case line == "DELETED":
+				deleted[i] = true
+			case line == "NOT_FOUND":
+			default:
+				err = memcachedError(line)
+			}
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deleted, nil
+}
+
+// Exists reports whether memcached has the key
+func (mc *MemcachedClient) Exists(ctx context.Context, key string) (bool, error) {
+	_, ok, err := mc.TTL(ctx, key)
+	return ok, err
+}
+
+// TTL returns the time the key has left in memcached
+func (mc *MemcachedClient) TTL(ctx context.Context, key string) (time.Duration, bool, error) {
+	if err := checkMemcachedKey(key); err != nil {
+		return 0, false, err
+	}
+	var ttl time.Duration
+	var ok bool
+	err := mc.do(ctx, func(cn *memcachedConn) error {
+		fmt.Fprintf(cn.w, "mg %s t\r\n", key)
+		if err := cn.w.Flush(); err != nil {
+			return err
+		}
+		line, err := cn.readLine()
+		if err != nil {
+			return err
+		}
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) > 0 && fields[0] == "EN":
+			return nil
+		case len(fields) > 0 && fields[0] == "HD":
+			ok = true
+			ttl, err = memcachedTTL(fields[1:])
+			return err
+		}
+		return memcachedError(line)
+	})
+	return ttl, ok, err
+}
+
+// do runs f with a connection to memcached. The connection is abandoned when
+// ctx is done, so f returns as soon as the request is gone, or after Timeout
+// when ctx has no deadline.
+func (mc *MemcachedClient) do(ctx context.Context, f func(cn *memcachedConn) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		timeout := mc.Timeout
+		if timeout == 0 {
+			timeout = memcachedTimeout
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	cn, err := mc.conn(ctx)
+	if err != nil {
+		return err
+	}
+
+	// ctx alone ends the round trip, so an error it caused is its own
+	cn.SetDeadline(time.Time{})
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			// unblocks any read or write in progress
+			cn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	err = f(cn)
+	close(stop)
+	<-stopped
+
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		}
+		if _, ok := err.(memcachedError); !ok {
+			// the connection is in an unknown state
+			cn.Close()
+			return err
+		}
+	}
+	mc.release(cn)
+	return err
+}
+
+// conn returns an idle connection, or a new one if there are none
+func (mc *MemcachedClient) conn(ctx context.Context) (*memcachedConn, error) {
+	mc.mux.Lock()
+	if n := len(mc.idle); n > 0 {
+		cn := mc.idle[n-1]
+		mc.idle = mc.idle[:n-1]
+		mc.mux.Unlock()
+		return cn, nil
+	}
+	mc.mux.Unlock()
+
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", mc.Addr)
+	if err != nil {
+		return nil, err
+	}
+	return &memcachedConn{Conn: c, r: bufio.NewReader(c), w: bufio.NewWriter(c)}, nil
+}
+
+// release keeps cn for reuse, unless enough connections are idle already
+func (mc *MemcachedClient) release(cn *memcachedConn) {
+	mc.mux.Lock()
+	defer mc.mux.Unlock()
+	if len(mc.idle) >= memcachedMaxIdle {
+		cn.Close()
+		return
+	}
+	mc.idle = append(mc.idle, cn)
+}
+
+// Close closes the idle connections
+func (mc *MemcachedClient) Close() error {
+	mc.mux.Lock()
+	defer mc.mux.Unlock()
+	for _, cn := range mc.idle {
+		cn.Close()
+	}
+	mc.idle = nil
+	return nil
+}
+
+// readLine reads a reply line, an error reply is returned as a memcachedError
+func (cn *memcachedConn) readLine() (string, error) {
+	line, err := cn.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+	if line == "ERROR" || strings.HasPrefix(line, "CLIENT_ERROR") || strings.HasPrefix(line, "SERVER_ERROR") {
+		return "", memcachedError(line)
+	}
+	return line, nil
+}
+
+// readItem reads the reply to "mg <key> v t", nil if memcached does not have
+// the key
+func (cn *memcachedConn) readItem() (*Item, error) {
+	line, err := cn.readLine()
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) > 0 && fields[0] == "EN" {
+		return nil, nil
+	}
+	if len(fields) < 2 || fields[0] != "VA" {
+		return nil, memcachedError(line)
+	}
+	size, err := strconv.Atoi(fields[1])
+	if err != nil || size < 0 {
+		return nil, fmt.Errorf("memcached: bad value size in %q", line)
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(cn.r, data); err != nil {
+		return nil, err
+	}
+	ttl, err := memcachedTTL(fields[2:])
+	if err != nil {
+		return nil, err
+	}
+	return &Item{Value: string(data[:size]), TTL: ttl}, nil
+}
+
+// memcachedTTL finds the t flag in the flags of a meta reply, -1 means the
+// key does not expire
+func memcachedTTL(flags []string) (time.Duration, error) {
+	for _, f := range flags {
+		if !strings.HasPrefix(f, "t") {
+			continue
+		}
+		secs, err := strconv.ParseInt(f[1:], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("memcached: bad ttl %q", f)
+		}
+		if secs < 0 {
+			return 0, nil
+		}
+		return time.Duration(secs) * time.Second, nil
+	}
+	return 0, nil
+}
+
+// memcachedExptime turns ttl into the expiry memcached takes. It only counts
+// whole seconds, so ttl is rounded up rather than becoming zero, which would
+// mean the key never expires.
+func memcachedExptime(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	secs := int64((ttl + time.Second - 1) / time.Second)
+	if secs > memcachedMaxRelativeTTL {
+		return time.Now().Add(ttl).Unix()
+	}
+	return secs
+}
+
+// checkMemcachedKey returns an error for keys memcached does not accept,
+// which are long keys and keys with spaces or control characters
+func checkMemcachedKey(key string) error {
+	if key == "" || len(key) > memcachedMaxKeyLen {
+		return fmt.Errorf("memcached: key must be 1 to %d bytes", memcachedMaxKeyLen)
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return fmt.Errorf("memcached: bad key %q", key)
+		}
+	}
+	return nil
+}
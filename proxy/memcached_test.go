@@ -0,0 +1,339 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/assert"
+)
+
+// fakeMemcached is a stand-in memcached server that understands the commands
+// MemcachedClient sends: version, set, delete and mg with the v and t flags
+type fakeMemcached struct {
+	l        net.Listener
+	maxValue int
+
+	mux    sync.Mutex
+	values map[string]fakeMemcachedEntry
+}
+
+type fakeMemcachedEntry struct {
+	value   string
+	expires time.Time
+}
+
+func startFakeMemcached(t *testing.T) *fakeMemcached {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &fakeMemcached{l: l, maxValue: 1024, values: make(map[string]fakeMemcachedEntry)}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go m.serve(c)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return m
+}
+
+func (m *fakeMemcached) Addr() string {
+	return m.l.Addr().String()
+}
+
+func (m *fakeMemcached) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	w := bufio.NewWriter(c)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			w.WriteString("ERROR\r\n")
+			continue
+		}
+		switch args[0] {
+		case "version":
+			w.WriteString("VERSION 1.6.9\r\n")
+		case "set":
+			if len(args) != 5 {
+				w.WriteString("ERROR\r\n")
+				break
+			}
+			exptime, _ := strconv.ParseInt(args[3], 10, 64)
+			size, _ := strconv.Atoi(args[4])
+			data := make([]byte, size+2)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return
+			}
+			if size > m.maxValue {
+				w.WriteString("SERVER_ERROR object too large for cache\r\n")
+				break
+			}
+			e := fakeMemcachedEntry{value: string(data[:size])}
+			if exptime > memcachedMaxRelativeTTL {
+				e.expires = time.Unix(exptime, 0)
+			} else if exptime > 0 {
+				e.expires = time.Now().Add(time.Duration(exptime) * time.Second)
+			}
+			m.mux.Lock()
+			m.values[args[1]] = e
+			m.mux.Unlock()
+			w.WriteString("STORED\r\n")
+		case "delete":
+			m.mux.Lock()
+			_, ok := m.get(args[1])
+			delete(m.values, args[1])
+			m.mux.Unlock()
+			if ok {
+				w.WriteString("DELETED\r\n")
+			} else {
+				w.WriteString("NOT_FOUND\r\n")
+			}
+		case "mg":
+			m.mux.Lock()
+			e, ok := m.get(args[1])
+			m.mux.Unlock()
+			if !ok {
+				w.WriteString("EN\r\n")
+				break
+			}
+			var flags []string
+			value := false
+			for _, f := range args[2:] {
+				switch f {
+				case "v":
+					value = true
+				case "t":
+					ttl := int64(-1)
+					if !e.expires.IsZero() {
+						ttl = int64(time.Until(e.expires).Round(time.Second) / time.Second)
+					}
+					flags = append(flags, fmt.Sprintf("t%d", ttl))
+				}
+			}
+			if value {
+				fmt.Fprintf(w, "VA %d %s\r\n%s\r\n", len(e.value), strings.Join(flags, " "), e.value)
+			} else {
+				fmt.Fprintf(w, "HD %s\r\n", strings.Join(flags, " "))
+			}
+		default:
+			w.WriteString("ERROR\r\n")
+		}
+		if r.Buffered() == 0 {
+			w.Flush()
+		}
+	}
+}
+
+// get returns the entry for key unless it has expired, the lock must be held
+func (m *fakeMemcached) get(key string) (fakeMemcachedEntry, bool) {
+	e, ok := m.values[key]
+	if ok && !e.expires.IsZero() && !time.Now().Before(e.expires) {
+		delete(m.values, key)
+		return fakeMemcachedEntry{}, false
+	}
+	return e, ok
+}
+
+func TestMemcachedClient(t *testing.T) {
+	assert := assert.New(t)
+
+	server := startFakeMemcached(t)
+	defaultTTL := 10 * time.Second
+	mc, err := NewMemcachedClient(&defaultTTL, server.Addr())
+	assert.NoError(err)
+	defer mc.Close()
+
+	var ctx = context.Background()
+	value, err := mc.Get(ctx, "tita")
+	assert.NoError(err)
+	assert.Nil(value)
+
+	// memcached has to be there
+	_, err = NewMemcachedClient(nil, "127.0.0.1:1")
+	assert.Error(err)
+
+	// keys without a ttl get the default one
+	err = mc.Put(ctx, "tita", "is fire", 0)
+	assert.NoError(err)
+	items, err := mc.MGet(ctx, []string{"tita"})
+	assert.NoError(err)
+	assert.Equal("is fire", items[0].Value)
+	assert.Equal(defaultTTL, items[0].TTL)
+
+	// memcached counts seconds, so short ttls are rounded up rather than
+	// never expiring
+	err = mc.Put(ctx, "roxi", "rocks\r\nEND", 10*time.Millisecond)
+	assert.NoError(err)
+	ttl, ok, err := mc.TTL(ctx, "roxi")
+	assert.NoError(err)
+	assert.True(ok)
+	assert.Equal(time.Second, ttl)
+
+	// and long ones are sent as a unix time
+	err = mc.Put(ctx, "roxi", "rocks\r\nEND", 60*24*time.Hour)
+	assert.NoError(err)
+	ttl, _, err = mc.TTL(ctx, "roxi")
+	assert.NoError(err)
+	assert.InDelta(60*24*time.Hour, ttl, float64(2*time.Second))
+
+	errs := mc.MSet(ctx, []string{"pip", "merry", "big"}, []string{"squeak", "brandybuck", strings.Repeat("x", 2048)}, time.Hour, false)
+	assert.NoError(errs[0])
+	assert.NoError(errs[1])
+	assert.EqualError(errs[2], "memcached: SERVER_ERROR object too large for cache")
+	errs = mc.MSet(ctx, []string{"pip"}, []string{"squeak"}, 0, true)
+	assert.Equal(errMemcachedAtomic, errs[0])
+
+	items, err = mc.MGet(ctx, []string{"pip", "nobody", "roxi", "big"})
+	assert.NoError(err)
+	assert.Equal("squeak", items[0].Value)
+	assert.Equal(time.Hour, items[0].TTL)
+	assert.Nil(items[1])
+	assert.Equal("rocks\r\nEND", items[2].Value)
+	assert.Nil(items[3])
+
+	deleted, err := mc.Delete(ctx, "pip")
+	assert.NoError(err)
+	assert.True(deleted)
+	deleted, err = mc.Delete(ctx, "pip")
+	assert.NoError(err)
+	assert.False(deleted)
+	ok, err = mc.Exists(ctx, "pip")
+	assert.NoError(err)
+	assert.False(ok)
+	ok, err = mc.Exists(ctx, "merry")
+	assert.NoError(err)
+	assert.True(ok)
+
+	// memcached keys can not have spaces
+	err = mc.Put(ctx, "users/42 profile", "roxi", 0)
+	assert.Error(err)
+	_, err = mc.MGet(ctx, []string{"pip", "users/42 profile"})
+	assert.Error(err)
+	// and keys that are too long are never there
+	items, err = mc.MGet(ctx, []string{"merry", strings.Repeat("x", 251)})
+	assert.NoError(err)
+	assert.Equal("brandybuck", items[0].Value)
+	assert.Nil(items[1])
+
+	deletes, err := mc.MDelete(ctx, []string{"merry", "nobody", strings.Repeat("x", 251)})
+	assert.NoError(err)
+	assert.Equal([]bool{true, false, false}, deletes)
+	ok, err = mc.Exists(ctx, "merry")
+	assert.NoError(err)
+	assert.False(ok)
+	_, err = mc.MDelete(ctx, []string{"pip", "users/42 profile"})
+	assert.Error(err)
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = mc.Get(cancelled, "merry")
+	assert.Equal(context.Canceled, err)
+}
+
+func TestMemcachedTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	// a memcached that takes connections but never answers
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(err)
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	mc := &MemcachedClient{Addr: l.Addr().String(), Timeout: 50 * time.Millisecond}
+	defer mc.Close()
+	start := time.Now()
+	_, err = mc.Get(context.Background(), "tita")
+	assert.Equal(context.DeadlineExceeded, err)
+	assert.Less(int64(time.Since(start)), int64(time.Second))
+}
+
+func TestMemcachedExptime(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(int64(0), memcachedExptime(0))
+	assert.Equal(int64(1), memcachedExptime(time.Millisecond))
+	assert.Equal(int64(2), memcachedExptime(1500*time.Millisecond))
+	assert.Equal(int64(memcachedMaxRelativeTTL), memcachedExptime(memcachedMaxRelativeTTL*time.Second))
+	assert.InDelta(time.Now().Add(31*24*time.Hour).Unix(), memcachedExptime(31*24*time.Hour), 1)
+}
+
+func TestProxyWithMemcached(t *testing.T) {
+	assert := assert.New(t)
+
+	server := startFakeMemcached(t)
+	duration, _ := time.ParseDuration("10s")
+	config := Config{
+		Backend:      "memcached",
+		MemcachedUrl: server.Addr(),
+		CacheTTL:     &duration,
+	}
+	proxy := NewProxyCache(config)
+	defer proxy.Close()
+	handler := http.HandlerFunc(proxy.PayloadHandler)
+
+	req, _ := http.NewRequest("PUT", "/users/42", strings.NewReader("roxi"))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(http.StatusOK, rr.Code)
+
+	// a new proxy reads it back from memcached
+	proxy2 := NewProxyCache(config)
+	defer proxy2.Close()
+	req, _ = http.NewRequest("GET", "/users/42", nil)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(proxy2.PayloadHandler).ServeHTTP(rr, req)
+	assert.Equal(`{"key":"users/42","value":"roxi"}`, rr.Body.String())
+
+	req, _ = http.NewRequest("DELETE", "/users/42", nil)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(http.StatusOK, rr.Code)
+	ok, err := proxy.cache.Exists(context.Background(), "users/42")
+	assert.NoError(err)
+	assert.False(ok)
+
+	// a value whose content type key would be too long is not stored
+	long := strings.Repeat("x", memcachedMaxKeyLen-len(contentTypeSuffix)+1)
+	req, _ = http.NewRequest("PUT", "/"+long, strings.NewReader("png"))
+	req.Header.Set("Content-Type", "image/png")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(http.StatusInternalServerError, rr.Code)
+	ok, err = proxy.cache.Exists(context.Background(), long)
+	assert.NoError(err)
+	assert.False(ok)
+
+	// MSET is atomic, which memcached can not do, and says so
+	client := startRESPServer(t, proxy)
+	err = client.MSet(context.Background(), "pip", "squeak", "merry", "brandybuck").Err()
+	assert.EqualError(err, "ERR MSET is atomic and the memcached backend has no transactions, use SET for each key")
+	err = client.Set(context.Background(), "pip", "squeak", 0).Err()
+	assert.NoError(err)
+}
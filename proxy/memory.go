@@ -0,0 +1,302 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryCache is an external cache that lives in the proxy's own process, so
+// the proxy can run without redis. Proxies in the same process that share one
+// can pass messages through it, and like redis with keyspace notifications
+// on it reports set, del and expired events on the keyspace channels.
+type MemoryCache struct {
+	mux        sync.Mutex
+	defaultTTL time.Duration
+	values     map[string]memoryValue
+	expiry     *expiryQueue
+
+	subscribers    map[int]memorySubscriber
+	lastSubscriber int
+}
+
+type memoryValue struct {
+	value string
+	// expires is zero when the key does not expire
+	expires time.Time
+}
+
+// memorySubscriber gets the messages sent on channel, or on every channel
+// matching it when it is a pattern
+type memorySubscriber struct {
+	channel string
+	pattern bool
+	handle  func(channel string, message string)
+}
+
+// keyEvent is a keyspace notification that has yet to be sent
+type keyEvent struct {
+	key   string
+	event string
+}
+
+// NewMemoryCache creates an empty MemoryCache. Keys stored without a ttl
+// expire after defaultTTL, nil means they do not expire.
+func NewMemoryCache(defaultTTL *time.Duration) *MemoryCache {
+	m := &MemoryCache{
+		values:      make(map[string]memoryValue),
+		expiry:      newExpiryQueue(),
+		subscribers: make(map[int]memorySubscriber),
+	}
+	if defaultTTL != nil {
+		m.defaultTTL = *defaultTTL
+	}
+	return m
+}
+
+// Put stores the value for ttl, zero uses the default
+func (m *MemoryCache) Put(ctx context.Context, key string, value string, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mux.Lock()
+	events := m.expire(time.Now())
+	events = append(events, m.put(key, value, ttl))
+	m.mux.Unlock()
+	m.notify(events)
+	return nil
+}
+
+// put stores the value, the lock must be held
+func (m *MemoryCache) put(key string, value string, ttl time.Duration) keyEvent {
+	if ttl == 0 {
+		ttl = m.defaultTTL
+	}
+	v := memoryValue{value: value}
+	if ttl > 0 {
+		v.expires = time.Now().Add(ttl)
+		m.expiry.Schedule(key, v.expires)
+	} else {
+		m.expiry.Unschedule(key)
+	}
+	m.values[key] = v
+	return keyEvent{key: key, event: "set"}
+}
+
+// Get gets the value of key, nil if the cache does not have it
+func (m *MemoryCache) Get(ctx context.Context, key string) (*string, error) {
+	items, err := m.MGet(ctx, []string{key})
+	if err != nil || items[0] == nil {
+		return nil, err
+	}
+	return &items[0].Value, nil
+}
+
+// MGet gets many keys at once, keys the cache does not have are nil
+func (m *MemoryCache) MGet(ctx context.Context, keys []string) ([]*Item, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	items := make([]*Item, len(keys))
+	m.mux.Lock()
+	events := m.expire(now)
+	for i, key := range keys {
+		v, ok := m.values[key]
+		if !ok {
+			continue
+		}
+		items[i] = &Item{Value: v.value}
+		if !v.expires.IsZero() {
+			items[i].TTL = v.expires.Sub(now)
+		}
+	}
+	m.mux.Unlock()
+	m.notify(events)
+	return items, nil
+}
+
+// MSet stores values[i] for keys[i], all of them at once
+func (m *MemoryCache) MSet(ctx context.Context, keys []string, values []string, ttl time.Duration, atomic bool) []error {
+	errs := make([]error, len(keys))
+	if err := ctx.Err(); err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	m.mux.Lock()
+	events := m.expire(time.Now())
+	for i, key := range keys {
+		events = append(events, m.put(key, values[i], ttl))
+	}
+	m.mux.Unlock()
+	m.notify(events)
+	return errs
+}
+
+// Delete removes the key and reports whether it was there
+func (m *MemoryCache) Delete(ctx context.Context, key string) (bool, error) {
+	deleted, err := m.MDelete(ctx, []string{key})
+	if err != nil {
+		return false, err
+	}
+	return deleted[0], nil
+}
+
+// MDelete removes many keys at once and reports whether each was there
+func (m *MemoryCache) MDelete(ctx context.Context, keys []string) ([]bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	deleted := make([]bool, len(keys))
+	m.mux.Lock()
+	events := m.expire(time.Now())
+	for i, key := range keys {
+		if _, ok := m.values[key]; ok {
+			delete(m.values, key)
+			m.expiry.Unschedule(key)
+			events = append(events, keyEvent{key: key, event: "del"})
+			deleted[i] = true
+		}
+	}
+	m.mux.Unlock()
+	m.notify(events)
+	return deleted, nil
+}
+
+// Exists reports whether the cache has the key
+func (m *MemoryCache) Exists(ctx context.Context, key string) (bool, error) {
+	_, ok, err := m.TTL(ctx, key)
+	return ok, err
+}
+
+// TTL returns the time the key has left, zero if it does not expire
+func (m *MemoryCache) TTL(ctx context.Context, key string) (time.Duration, bool, error) {
+	items, err := m.MGet(ctx, []string{key})
+	if err != nil || items[0] == nil {
+		return 0, false, err
+	}
+	return items[0].TTL, true, nil
+}
+
+// Len returns the number of keys in the cache
+func (m *MemoryCache) Len() int {
+	m.mux.Lock()
+	events := m.expire(time.Now())
+	n := len(m.values)
+	m.mux.Unlock()
+	m.notify(events)
+	return n
+}
+
+// expire removes the keys that are due, the lock must be held. Keys are only
+// removed when the cache is used, which is when it would notice them anyway.
+func (m *MemoryCache) expire(now time.Time) []keyEvent {
+	var events []keyEvent
+	for _, key := range m.expiry.PopDue(now) {
+		delete(m.values, key)
+		events = append(events, keyEvent{key: key, event: "expired"})
+	}
+	return events
+}
+
+// notify sends keyspace notifications for events. It is called without the
+// lock, so subscribers can use the cache.
+func (m *MemoryCache) notify(events []keyEvent) {
+	for _, e := range events {
+		m.publish(keyspacePrefix+e.key, e.event)
+	}
+}
+
+// Publish sends message to everyone subscribed to channel
+func (m *MemoryCache) Publish(ctx context.Context, channel string, message string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.publish(channel, message)
+	return nil
+}
+
+// publish hands message to the subscribers of channel before returning
+func (m *MemoryCache) publish(channel string, message string) {
+	m.mux.Lock()
+	var handlers []func(string, string)
+	for _, s := range m.subscribers {
+		if s.channel == channel || (s.pattern && matchPattern(s.channel, channel)) {
+			handlers = append(handlers, s.handle)
+		}
+	}
+	m.mux.Unlock()
+	for _, handle := range handlers {
+		handle(channel, message)
+	}
+}
+
+// Subscribe calls handle with every message sent on channel until the
+// returned function is called
+func (m *MemoryCache) Subscribe(channel string, handle func(message string)) (func() error, error) {
+	return m.subscribe(memorySubscriber{
+		channel: channel,
+		handle:  func(channel string, message string) { handle(message) },
+	}), nil
+}
+
+// PSubscribe is like Subscribe for every channel matching pattern
+func (m *MemoryCache) PSubscribe(pattern string, handle func(channel string, message string)) (func() error, error) {
+	return m.subscribe(memorySubscriber{channel: pattern, pattern: true, handle: handle}), nil
+}
+
+func (m *MemoryCache) subscribe(s memorySubscriber) func() error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.lastSubscriber++
+	id := m.lastSubscriber
+	m.subscribers[id] = s
+	return func() error {
+		m.mux.Lock()
+		defer m.mux.Unlock()
+		delete(m.subscribers, id)
+		return nil
+	}
+}
+
+// matchPattern reports whether s matches the glob-style pattern like redis
+// does for PSUBSCRIBE: * matches any run of characters, ? any single one and
+// \ makes the next character match itself. Unlike path.Match, * also matches
+// slashes.
+func matchPattern(pattern string, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if matchPattern(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		s = s[1:]
+	}
+	return len(s) == 0
+}
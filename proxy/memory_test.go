@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/assert"
+)
+
+func TestMemoryCache(t *testing.T) {
+	assert := assert.New(t)
+
+	var ctx = context.Background()
+	defaultTTL := 50 * time.Millisecond
+	m := NewMemoryCache(&defaultTTL)
+
+	value, err := m.Get(ctx, "tita")
+	assert.NoError(err)
+	assert.Nil(value)
+
+	err = m.Put(ctx, "tita", "is fire", 0)
+	assert.NoError(err)
+	items, err := m.MGet(ctx, []string{"tita"})
+	assert.NoError(err)
+	assert.Equal("is fire", items[0].Value)
+	assert.InDelta(defaultTTL, items[0].TTL, float64(10*time.Millisecond))
+
+	// keys stored with a ttl keep it
+	err = m.Put(ctx, "roxi", "rocks", time.Hour)
+	assert.NoError(err)
+	ttl, ok, err := m.TTL(ctx, "roxi")
+	assert.NoError(err)
+	assert.True(ok)
+	assert.InDelta(time.Hour, ttl, float64(time.Second))
+
+	errs := m.MSet(ctx, []string{"pip", "merry"}, []string{"squeak", "brandybuck"}, time.Hour, true)
+	assert.Equal([]error{nil, nil}, errs)
+	items, err = m.MGet(ctx, []string{"pip", "nobody", "merry"})
+	assert.NoError(err)
+	assert.Equal("squeak", items[0].Value)
+	assert.Nil(items[1])
+	assert.Equal("brandybuck", items[2].Value)
+
+	deleted, err := m.Delete(ctx, "pip")
+	assert.NoError(err)
+	assert.True(deleted)
+	deleted, err = m.Delete(ctx, "pip")
+	assert.NoError(err)
+	assert.False(deleted)
+	m.Put(ctx, "pip", "squeak", 0)
+	deletes, err := m.MDelete(ctx, []string{"nobody", "pip"})
+	assert.NoError(err)
+	assert.Equal([]bool{false, true}, deletes)
+	ok, err = m.Exists(ctx, "pip")
+	assert.NoError(err)
+	assert.False(ok)
+
+	// the default ttl runs out
+	time.Sleep(2 * defaultTTL)
+	ok, err = m.Exists(ctx, "tita")
+	assert.NoError(err)
+	assert.False(ok)
+	assert.Equal(2, m.Len())
+
+	// requests that are gone do not change anything
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	err = m.Put(cancelled, "tita", "is fire", 0)
+	assert.Equal(context.Canceled, err)
+	_, err = m.Get(cancelled, "roxi")
+	assert.Equal(context.Canceled, err)
+	assert.Equal(2, m.Len())
+}
+
+func TestMemoryCachePubSub(t *testing.T) {
+	assert := assert.New(t)
+
+	var ctx = context.Background()
+	m := NewMemoryCache(nil)
+
+	var messages []string
+	unsubscribe, err := m.Subscribe("news", func(message string) {
+		messages = append(messages, message)
+	})
+	assert.NoError(err)
+	var events []string
+	_, err = m.PSubscribe(keyspacePrefix+"*", func(channel string, event string) {
+		events = append(events, strings.TrimPrefix(channel, keyspacePrefix)+" "+event)
+	})
+	assert.NoError(err)
+
+	m.Publish(ctx, "news", "roxi rocks")
+	m.Publish(ctx, "olds", "tita is fire")
+	assert.Equal([]string{"roxi rocks"}, messages)
+	unsubscribe()
+	m.Publish(ctx, "news", "roxi still rocks")
+	assert.Equal([]string{"roxi rocks"}, messages)
+
+	m.Put(ctx, "users/42", "roxi", 10*time.Millisecond)
+	m.Delete(ctx, "users/42")
+	m.Put(ctx, "users/43", "tita", 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	m.Get(ctx, "users/43")
+	assert.Equal([]string{"users/42 set", "users/42 del", "users/43 set", "users/43 expired"}, events)
+}
+
+func TestMatchPattern(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(matchPattern("*", ""))
+	assert.True(matchPattern("*", "users/42"))
+	assert.True(matchPattern("users/*", "users/42/profile"))
+	assert.True(matchPattern("users/??", "users/42"))
+	assert.True(matchPattern("*/42/*", "users/42/profile"))
+	assert.True(matchPattern(`roxi\*`, "roxi*"))
+	assert.False(matchPattern(`roxi\*`, "roxi rocks"))
+	assert.False(matchPattern("users/??", "users/421"))
+	assert.False(matchPattern("users/*", "user/42"))
+	assert.False(matchPattern("tita", "titan"))
+}
+
+func TestProxyWithMemoryCache(t *testing.T) {
+	assert := assert.New(t)
+
+	duration, _ := time.ParseDuration("10s")
+	config := Config{
+		CacheTTL:            &duration,
+		InvalidationChannel: "invalidations",
+	}
+
+	// two proxies in front of the same cache keep each other up to date
+	// without redis
+	m := NewMemoryCache(nil)
+	proxy1 := NewProxyCacheWithCache(config, m)
+	defer proxy1.Close()
+	proxy2 := NewProxyCacheWithCache(config, m)
+	defer proxy2.Close()
+
+	req, _ := http.NewRequest("PUT", "/tita", strings.NewReader("is fire"))
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(proxy1.PayloadHandler).ServeHTTP(rr, req)
+	assert.Equal(http.StatusOK, rr.Code)
+
+	req, _ = http.NewRequest("GET", "/tita", nil)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(proxy2.PayloadHandler).ServeHTTP(rr, req)
+	assert.Equal(`{"key":"tita","value":"is fire"}`, rr.Body.String())
+	_, ok := proxy2.Peek("tita")
+	assert.True(ok)
+
+	var ctx = context.Background()
+	_, err := proxy1.HandleDelete(ctx, "tita")
+	assert.NoError(err)
+	_, ok = proxy2.Peek("tita")
+	assert.False(ok)
+
+	// a batch is announced in one message
+	var messages []string
+	unsubscribe, err := m.Subscribe("invalidations", func(message string) {
+		messages = append(messages, message)
+	})
+	assert.NoError(err)
+	defer unsubscribe()
+	for _, key := range []string{"roxi", "tita", "heff"} {
+		proxy2.PutValue(key, ValueStore{Value: "old"}, 0)
+	}
+	req, _ = http.NewRequest("POST", "/_mset", strings.NewReader(`{"roxi": "rocks", "tita": "is cool", "heff": "zao"}`))
+	rr = httptest.NewRecorder()
+	proxy1.ServeHTTP(rr, req)
+	assert.Equal(http.StatusOK, rr.Code)
+	assert.Len(messages, 1)
+	assert.Equal(0, proxy2.Len())
+
+	// the backend is picked by the config too
+	config.Backend = "memory"
+	proxy3 := NewProxyCache(config)
+	defer proxy3.Close()
+	assert.IsType(&MemoryCache{}, proxy3.cache)
+}
@@ -7,7 +7,6 @@ import (
 	"sync"
 	"testing"
 
-	redis "github.com/go-redis/redis/v8"
 	assert "github.com/stretchr/testify/assert"
 )
 
@@ -16,30 +15,19 @@ func TestSequentialProcessing(t *testing.T) {
 	// this is the same as setting the config.ProxyClientLimit to 1
 	// also known as "PROXY_CLIENT_LIMIT" env var
 
-	// normally I would just test the middleware function with mocks
-	// but since the requirement is to prove the proxy can perform and still use
-	// redis backing cache I do not use mocks
+	// the proxy runs for real in front of an in-memory external cache,
+	// rather than the middleware being tested with mocks
 	assert := assert.New(t)
 
-	config := NewConfig()
-	proxy := NewProxyCache(config)
+	// the external cache lives in memory, so the test does not need redis
+	backend := NewMemoryCache(nil)
+	proxy := NewProxyCacheWithCache(Config{}, backend)
+	t.Cleanup(proxy.Close)
 
 	var ctx = context.Background()
-	redisClient := redis.NewClient(&redis.Options{
-		Addr:     config.RedisUrl,
-		Password: "", // no password set
-		DB:       0,  // use default DB
-	})
-	// redis client that should be running
-	_, err := redisClient.Ping(ctx).Result()
+	err := backend.Put(ctx, "bing", "charlie", 0)
 	assert.NoError(err)
-
-	// get rid of value for test
-	redisClient.Del(ctx, "bing")
-	redisClient.Del(ctx, "bong")
-	err = redisClient.Set(ctx, "bing", "charlie", 0).Err()
-	assert.NoError(err)
-	err = redisClient.Set(ctx, "bong", "is cool", 0).Err()
+	err = backend.Put(ctx, "bong", "is cool", 0)
 	assert.NoError(err)
 
 	handler := http.HandlerFunc(LimitNumClients(proxy.PayloadHandler, 1))
@@ -54,25 +42,25 @@ func TestSequentialProcessing(t *testing.T) {
 		defer wg.Done()
 		rr := httptest.NewRecorder()
 		handler.ServeHTTP(rr, req1)
-		assert.Equal(`{"bing": "charlie"}`, rr.Body.String())
+		assert.Equal(`{"key":"bing","value":"charlie"}`, rr.Body.String())
 	}()
 	go func() {
 		defer wg.Done()
 		rr := httptest.NewRecorder()
 		handler.ServeHTTP(rr, req2)
-		assert.Equal(`{"bong": "is cool"}`, rr.Body.String())
+		assert.Equal(`{"key":"bong","value":"is cool"}`, rr.Body.String())
 	}()
 	go func() {
 		defer wg.Done()
 		rr := httptest.NewRecorder()
 		handler.ServeHTTP(rr, req1)
-		assert.Equal(`{"bing": "charlie"}`, rr.Body.String())
+		assert.Equal(`{"key":"bing","value":"charlie"}`, rr.Body.String())
 	}()
 	go func() {
 		defer wg.Done()
 		rr := httptest.NewRecorder()
 		handler.ServeHTTP(rr, req2)
-		assert.Equal(`{"bong": "is cool"}`, rr.Body.String())
+		assert.Equal(`{"key":"bong","value":"is cool"}`, rr.Body.String())
 	}()
 	go func() {
 		defer wg.Done()
@@ -94,25 +82,15 @@ func TestNonSequentialProcessing(t *testing.T) {
 	// do the same thing but set the value to something else like 10?
 	assert := assert.New(t)
 
-	config := NewConfig()
-	proxy := NewProxyCache(config)
+	// the external cache lives in memory, so the test does not need redis
+	backend := NewMemoryCache(nil)
+	proxy := NewProxyCacheWithCache(Config{}, backend)
+	t.Cleanup(proxy.Close)
 
 	var ctx = context.Background()
-	redisClient := redis.NewClient(&redis.Options{
-		Addr:     config.RedisUrl,
-		Password: "", // no password set
-		DB:       0,  // use default DB
-	})
-	// redis client that should be running
-	_, err := redisClient.Ping(ctx).Result()
-	assert.NoError(err)
-
-	// get rid of value for test
-	redisClient.Del(ctx, "bing")
-	redisClient.Del(ctx, "bong")
-	err = redisClient.Set(ctx, "bing", "charlie", 0).Err()
+	err := backend.Put(ctx, "bing", "charlie", 0)
 	assert.NoError(err)
-	err = redisClient.Set(ctx, "bong", "is cool", 0).Err()
+	err = backend.Put(ctx, "bong", "is cool", 0)
 	assert.NoError(err)
 
 	// this is how we can permit concurrent processing that is not sequential
@@ -127,25 +105,25 @@ func TestNonSequentialProcessing(t *testing.T) {
 		defer wg.Done()
 		rr := httptest.NewRecorder()
 		handler.ServeHTTP(rr, req1)
-		assert.Equal(rr.Body.String(), `{"bing": "charlie"}`)
+		assert.Equal(rr.Body.String(), `{"key":"bing","value":"charlie"}`)
 	}()
 	go func() {
 		defer wg.Done()
 		rr := httptest.NewRecorder()
 		handler.ServeHTTP(rr, req2)
-		assert.Equal(rr.Body.String(), `{"bong": "is cool"}`)
+		assert.Equal(rr.Body.String(), `{"key":"bong","value":"is cool"}`)
 	}()
 	go func() {
 		defer wg.Done()
 		rr := httptest.NewRecorder()
 		handler.ServeHTTP(rr, req1)
-		assert.Equal(rr.Body.String(), `{"bing": "charlie"}`)
+		assert.Equal(rr.Body.String(), `{"key":"bing","value":"charlie"}`)
 	}()
 	go func() {
 		defer wg.Done()
 		rr := httptest.NewRecorder()
 		handler.ServeHTTP(rr, req2)
-		assert.Equal(rr.Body.String(), `{"bong": "is cool"}`)
+		assert.Equal(rr.Body.String(), `{"key":"bong","value":"is cool"}`)
 	}()
 	go func() {
 		defer wg.Done()
@@ -1,30 +1,59 @@
 package proxy
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"path"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	// maxBatchKeys caps the keys of a /_mget or /_mset request, so a single
+	// request can not make the external cache do unbounded work
+	maxBatchKeys = 1000
+	// maxBatchBody caps the size in bytes of their bodies
+	maxBatchBody = 16 << 20
+)
+
 // ValueStore is a struct that holds values for the key related to its value and when it was last accessed
 type ValueStore struct {
 	LastRead   time.Time
 	Value      string
 	ExpiryTime time.Time
+	// ContentType is the media type the value was stored with, if any
+	ContentType string
 }
 
-// ProxyCache is a cache used by the proxy that is safe to use concurrently
+// ProxyCache is a cache used by the proxy that is safe to use concurrently.
+//
+// Keys are spread over shards that each have their own lock, so reads and
+// writes of different keys mostly do not wait on each other.
 type ProxyCache struct {
+	// coalescedGets counts the misses that were answered by another
+	// request's fetch from the external cache. It comes first so it is
+	// aligned for atomic access on 32 bit platforms.
+	coalescedGets uint64
+
+	// Data holds the keys and Mux guards it when the cache has a single
+	// shard, which is the default. With more shards every shard has its
+	// own map and lock, and Data is nil.
 	Data map[string]ValueStore
 	Mux  sync.Mutex
 
 	// MaxKeys optionally limits the total number of keys stored in
-	// the Data map at any time
+	// the cache at any time. It is split between the shards, which
+	// together hold exactly MaxKeys.
 	//
 	// Zero means no limit
 	MaxKeys int
@@ -34,157 +63,445 @@ type ProxyCache struct {
 	// Zero means no limit
 	KeyTimeout time.Duration
 
+	// KeyPathPrefix is the part of request paths that comes before the key,
+	// like /cache. Requests for paths outside it are rejected.
+	KeyPathPrefix string
+
 	// Cache is a cache used by the proxy that is not in-memory storage
 	cache Cache
+	// externalTTL is how long the external cache keeps keys by default
+	externalTTL time.Duration
+
+	shards []*cacheShard
+
+	// flights collapses concurrent misses for the same key
+	flights flightGroup
+
+	// id tells this proxy apart from the others sharing the external cache
+	id string
+	// pubsub, when set, carries invalidations between proxies on
+	// invalidationChannel
+	pubsub              PubSub
+	invalidationChannel string
+	// unsubscribe ends the subscriptions that invalidate keys
+	unsubscribe []func() error
+
+	// stop ends the expiry go routines
+	stop      chan struct{}
+	closeOnce sync.Once
 }
 
 // Put ...
 func (c *ProxyCache) Put(key string, value string) {
+	c.PutWithTTL(key, value, 0)
+}
 
-	c.Mux.Lock()
-	defer c.Mux.Unlock()
-
-	// only purge LLU if max key limit set
-	if c.MaxKeys != 0 && len(c.Data) == c.MaxKeys {
-		lastKey := ""
-		lastRead := time.Now()
-		for k := range c.Data {
-			v, ok := c.Data[k]
-			if ok && v.LastRead.Before(lastRead) {
-				lastKey = k
-				lastRead = v.LastRead
-			}
-		}
+// PutWithTTL stores the value for no longer than ttl, or KeyTimeout if that
+// is shorter. Zero means no limit for either.
+func (c *ProxyCache) PutWithTTL(key string, value string, ttl time.Duration) {
+	c.PutValue(key, ValueStore{Value: value}, ttl)
+}
 
-		// remove the key that was accessed a longest time
-		delete(c.Data, lastKey)
-	}
+// PutValue stores value along with its content type, like PutWithTTL
+func (c *ProxyCache) PutValue(key string, value ValueStore, ttl time.Duration) {
+	value.ExpiryTime = c.expiryTime(ttl)
+	c.shard(key).put(key, value)
+}
 
-	c.Data[key] = ValueStore{
-		Value:      value,
-		LastRead:   time.Now(),
-		ExpiryTime: time.Now().Add(c.KeyTimeout),
+// expiryTime returns when a key stored now for ttl expires, ttl is capped
+// at KeyTimeout. The zero time means never.
+func (c *ProxyCache) expiryTime(ttl time.Duration) time.Time {
+	if c.KeyTimeout > 0 && (ttl <= 0 || c.KeyTimeout < ttl) {
+		ttl = c.KeyTimeout
+	}
+	if ttl > 0 {
+		return time.Now().Add(ttl)
 	}
+	return time.Time{}
 }
 
 // Get ...
 func (c *ProxyCache) Get(key string) *string {
+	value, ok := c.GetValue(key)
+	if !ok {
+		return nil
+	}
+	return &value.Value
+}
 
-	c.Mux.Lock()
-	defer c.Mux.Unlock()
+// GetValue returns the value for key along with its content type
+func (c *ProxyCache) GetValue(key string) (ValueStore, bool) {
+	return c.shard(key).get(key)
+}
 
-	value, ok := c.Data[key]
+// Delete removes key from the local cache and reports whether it was there.
+// Like Invalidate, a value for the key that is being read from the external
+// cache at the same time is not stored, so a fetch that started before the
+// delete can not bring the key back.
+func (c *ProxyCache) Delete(key string) bool {
+	return c.shard(key).invalidate(key)
+}
 
-	if ok {
-		value.LastRead = time.Now()
-		c.Data[key] = value
-		return &value.Value
-	}
+// Invalidate drops key from the local cache because it changed in the
+// external cache. A value for a key in the same shard that is being read from
+// the external cache at the same time is not stored, as it may be the old one.
+func (c *ProxyCache) Invalidate(key string) {
+	c.shard(key).invalidate(key)
+}
 
-	return nil
+// InvalidateAll drops every key from the local cache
+func (c *ProxyCache) InvalidateAll() {
+	for _, s := range c.shards {
+		s.invalidateAll()
+	}
 }
 
-// ExpireKeys ...
-func (c *ProxyCache) ExpireKeys() {
+// invalidateKeys invalidates keys, or every key when keys is nil
+func (c *ProxyCache) invalidateKeys(keys []string) {
+	if keys == nil {
+		c.InvalidateAll()
+		return
+	}
+	for _, key := range keys {
+		c.Invalidate(key)
+	}
+}
 
-	// Iterate through all keys in the map to check if any have expired
-	// call from a go routine so that this is done async
-	go func() {
-		for true {
+// Peek returns what the local cache holds for key without counting it as a
+// read, so it does not change which keys get evicted
+func (c *ProxyCache) Peek(key string) (ValueStore, bool) {
+	return c.shard(key).peek(key)
+}
 
-			c.Mux.Lock()
+// Len returns the number of keys in the local cache
+func (c *ProxyCache) Len() int {
+	n := 0
+	for _, s := range c.shards {
+		n += s.len()
+	}
+	return n
+}
 
-			keysToExpire := []string{}
-			for k := range c.Data {
-				v, ok := c.Data[k]
-				if ok && v.ExpiryTime.Before(time.Now()) {
-					keysToExpire = append(keysToExpire, k)
-				}
-			}
+// expired reports whether the value has expired at the time now
+func (v ValueStore) expired(now time.Time) bool {
+	return !v.ExpiryTime.IsZero() && !v.ExpiryTime.After(now)
+}
 
-			for _, k := range keysToExpire {
-				delete(c.Data, k)
-			}
+func (c *ProxyCache) shard(key string) *cacheShard {
+	return c.shards[shardIndex(key, len(c.shards))]
+}
 
-			c.Mux.Unlock()
+// ExpireKeys starts a go routine per shard that removes keys once they
+// expire. Close stops them.
+func (c *ProxyCache) ExpireKeys() {
+	for _, s := range c.shards {
+		go s.expireKeys(c.stop)
+	}
+}
 
-			// sleep for the duration of the timeout
-			time.Sleep(c.KeyTimeout)
+// Close stops the go routines that expire keys and the subscription to
+// invalidations
+func (c *ProxyCache) Close() {
+	c.closeOnce.Do(func() {
+		close(c.stop)
+		for _, unsubscribe := range c.unsubscribe {
+			unsubscribe()
 		}
-	}()
+	})
 }
 
 // PayloadHandler ...
 func (c *ProxyCache) PayloadHandler(w http.ResponseWriter, r *http.Request) {
-	key := path.Base(r.URL.String())
-
-	w.Header().Set("Content-Type", "application/json")
+	key, ok := c.requestKey(r)
 
-	if key == "/" {
-		w.WriteHeader(http.StatusBadRequest)
-		io.WriteString(w, `{"error": "bad key"}`)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "bad key")
 		return
 	}
 	switch r.Method {
 	case http.MethodGet:
 
-		value, err := c.HandleGet(key)
+		value, err := c.HandleGetValue(r.Context(), key)
 
 		if err != nil {
 			log.Print(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			io.WriteString(w, `{"error": "failed get"}`)
+			writeError(w, http.StatusInternalServerError, "failed get")
 			return
 		}
 
 		if value == nil {
-			w.WriteHeader(http.StatusNotFound)
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+
+		if wantsRaw(r, value.ContentType) {
+			writeRaw(w, *value)
 			return
 		}
 
-		w.WriteHeader(http.StatusOK)
-		io.WriteString(w, fmt.Sprintf(`{"%v": "%v"}`, key, *value))
+		writeResponse(w, http.StatusOK, valueResponse(key, *value))
 
 	case http.MethodPut:
 
 		// parse body of request to get value
-		value, err := ioutil.ReadAll(r.Body)
+		body, err := ioutil.ReadAll(r.Body)
+
+		if err != nil {
+			log.Print(err)
+			writeError(w, http.StatusBadRequest, "bad value")
+			return
+		}
 
+		ttl, err := requestTTL(r)
 		if err != nil {
 			log.Print(err)
-			w.WriteHeader(http.StatusBadRequest)
-			io.WriteString(w, `{"error": "bad value"}`)
+			writeError(w, http.StatusBadRequest, "bad ttl")
 			return
 		}
 
-		err = c.HandlePut(key, string(value))
+		// the content type is kept with the value, so it can be served
+		// back as it was sent
+		value := ValueStore{Value: string(body), ContentType: r.Header.Get("Content-Type")}
+		err = c.HandlePutValue(r.Context(), key, value, ttl)
 
 		if err != nil {
 			log.Print(err)
-			w.WriteHeader(http.StatusInternalServerError)
-			io.WriteString(w, `{"error": "failed put"}`)
+			writeError(w, http.StatusInternalServerError, "failed put")
+			return
+		}
+
+		writeResponse(w, http.StatusOK, valueResponse(key, value))
+
+	case http.MethodDelete:
+
+		deleted, err := c.HandleDelete(r.Context(), key)
+
+		if err != nil {
+			log.Print(err)
+			writeError(w, http.StatusInternalServerError, "failed delete")
+			return
+		}
+
+		if !deleted {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+
+		writeResponse(w, http.StatusOK, response{Key: key, Deleted: true})
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// MGetHandler serves POST requests with a JSON list of keys, and replies with
+// the value of each key, null for the ones that are not cached anywhere. Keys
+// are written and replied with like the path of a GET, and a bad one fails
+// the whole request.
+func (c *ProxyCache) MGetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var keys []string
+	if !decodeBatch(w, r, &keys, "bad keys") || !checkBatchSize(w, len(keys)) {
+		return
+	}
+	for i, key := range keys {
+		var ok bool
+		if keys[i], ok = batchKey(key); !ok {
+			writeError(w, http.StatusBadRequest, "bad key")
+			return
+		}
+	}
+
+	values, err := c.HandleMGet(r.Context(), keys)
+	if err != nil {
+		log.Print(err)
+		writeError(w, http.StatusInternalServerError, "failed mget")
+		return
+	}
+
+	reply := valuesResponse{Values: make(map[string]*string, len(keys))}
+	for i, key := range keys {
+		if values[i] == nil {
+			reply.Values[key] = nil
+			continue
+		}
+		value, encoding := jsonValue(values[i].Value)
+		reply.Values[key] = &value
+		if encoding != "" {
+			if reply.Encodings == nil {
+				reply.Encodings = make(map[string]string)
+			}
+			reply.Encodings[key] = encoding
+		}
+	}
+	writeResponse(w, http.StatusOK, reply)
+}
+
+// MSetHandler serves POST requests with a JSON object of keys and values to
+// store. The ttl is set like for PUT, and ?atomic=1 stores all or none of the
+// keys. It replies with the status of each key. Keys are written like the path
+// of a PUT, and a bad one fails the whole request.
+func (c *ProxyCache) MSetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var items map[string]string
+	if !decodeBatch(w, r, &items, "bad values") || !checkBatchSize(w, len(items)) {
+		return
+	}
+
+	ttl, err := requestTTL(r)
+	if err != nil {
+		log.Print(err)
+		writeError(w, http.StatusBadRequest, "bad ttl")
+		return
+	}
+
+	atomically := false
+	if a := r.URL.Query().Get("atomic"); a != "" {
+		atomically, err = strconv.ParseBool(a)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "bad atomic")
 			return
 		}
+	}
 
-		w.WriteHeader(http.StatusOK)
-		io.WriteString(w, fmt.Sprintf(`{"%v": "%v}`, key, string(value)))
+	// keys are cleaned like the path of a PUT, two that turn out to be the
+	// same key would leave it to chance which value is stored
+	cleaned := make(map[string]string, len(items))
+	for key, value := range items {
+		k, ok := batchKey(key)
+		if _, dup := cleaned[k]; !ok || dup {
+			writeError(w, http.StatusBadRequest, "bad key")
+			return
+		}
+		cleaned[k] = value
+	}
+	keys := make([]string, 0, len(cleaned))
+	for key := range cleaned {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	values := make([]ValueStore, len(keys))
+	for i, key := range keys {
+		values[i] = ValueStore{Value: cleaned[key]}
+	}
+
+	errs := c.HandleMSet(r.Context(), keys, values, ttl, atomically)
+	// in a cluster the keys of an atomic write have to share a hash slot,
+	// which is up to the client
+	if len(errs) > 0 && errs[0] == errCrossSlot {
+		writeError(w, http.StatusBadRequest, errCrossSlot.Error())
+		return
+	}
+
+	reply := statusResponse{Status: make(map[string]string, len(keys))}
+	failed := 0
+	for i, key := range keys {
+		if errs[i] != nil {
+			log.Print(errs[i])
+			reply.Status[key] = "failed put"
+			failed++
+		} else {
+			reply.Status[key] = "ok"
+		}
+	}
+
+	status := http.StatusOK
+	switch {
+	case failed == 0:
+	case failed < len(keys):
+		// some keys were stored and some were not
+		status = http.StatusMultiStatus
 	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		io.WriteString(w, `{"error": "method not allowed"}`)
+		status = http.StatusInternalServerError
+	}
+	writeResponse(w, status, reply)
+}
+
+// decodeBatch decodes the JSON body of a /_mget or /_mset request into v. When
+// the body is too large or not what v expects it replies with an error, msg
+// for the latter, and returns false.
+func decodeBatch(w http.ResponseWriter, r *http.Request, v interface{}, msg string) bool {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBatchBody+1))
+	if err != nil {
+		log.Print(err)
+		writeError(w, http.StatusBadRequest, msg)
+		return false
+	}
+	if len(body) > maxBatchBody {
+		writeError(w, http.StatusRequestEntityTooLarge, "request too large")
+		return false
 	}
+	if err := json.Unmarshal(body, v); err != nil {
+		log.Print(err)
+		writeError(w, http.StatusBadRequest, msg)
+		return false
+	}
+	return true
+}
+
+// checkBatchSize replies with an error and returns false when a batch has
+// more than maxBatchKeys keys
+func checkBatchSize(w http.ResponseWriter, n int) bool {
+	if n > maxBatchKeys {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("too many keys, at most %d", maxBatchKeys))
+		return false
+	}
+	return true
 }
 
 // HandleGet gets key values from local or external cache
-func (c *ProxyCache) HandleGet(key string) (*string, error) {
+func (c *ProxyCache) HandleGet(ctx context.Context, key string) (*string, error) {
+	value, err := c.HandleGetValue(ctx, key)
+	if err != nil || value == nil {
+		return nil, err
+	}
+	return &value.Value, nil
+}
 
-	value := c.Get(key)
+// HandleGetValue is HandleGet for values that may have a content type
+func (c *ProxyCache) HandleGetValue(ctx context.Context, key string) (*ValueStore, error) {
 
-	if value != nil {
-		return value, nil
+	if value, ok := c.GetValue(key); ok {
+		return &value, nil
 	}
 
-	// try to get key value from external cache
-	cv, err := c.cache.Get(key)
+	// try to get key value from external cache, when a popular key expires
+	// every request for it misses at once so only one of them goes to the
+	// external cache and the rest wait for its answer
+	cv, err, shared := c.flights.Do(ctx, key, func(ctx context.Context) (*ValueStore, error) {
+		// another request may have stored the key since we looked
+		if value, ok := c.GetValue(key); ok {
+			return &value, nil
+		}
+
+		// fetch how long the key has left too, so we never keep it
+		// after the external cache has expired it
+		s := c.shard(key)
+		gen := s.generation()
+		values, err := c.fetchValues(ctx, []string{key})
+		if err != nil || values[0] == nil {
+			return nil, err
+		}
+		value := *values[0]
+
+		// store the value in the proxy cache, Put is cheap enough to do
+		// it before replying so the next read is a hit. An invalidation
+		// that came in while we were reading may be for the value we
+		// read, so then it is not stored.
+		s.putUnlessInvalidated(key, value, gen)
+		return &value, nil
+	})
+	if shared {
+		atomic.AddUint64(&c.coalescedGets, 1)
+	}
 	if err != nil {
 		return nil, err
 	} else if cv == nil {
@@ -192,31 +509,299 @@ func (c *ProxyCache) HandleGet(key string) (*string, error) {
 		return nil, nil
 	}
 
-	// store the value in the proxy cache
-	go c.Put(key, *cv)
-
 	return cv, nil
 
 }
 
-// HandlePut handles storing key and values at the local and external cache
-func (c *ProxyCache) HandlePut(key string, value string) error {
+// HandleMGet gets many keys at once, in the order of keys. Keys the local
+// cache does not have are read from the external cache in one go, and keys
+// neither has are nil.
+func (c *ProxyCache) HandleMGet(ctx context.Context, keys []string) ([]*ValueStore, error) {
+	values := make([]*ValueStore, len(keys))
+
+	// the keys to fetch, each once, and where their values go
+	var misses []string
+	positions := make(map[string][]int)
+	for i, key := range keys {
+		if value, ok := c.GetValue(key); ok {
+			values[i] = &value
+			continue
+		}
+		if _, ok := positions[key]; !ok {
+			misses = append(misses, key)
+		}
+		positions[key] = append(positions[key], i)
+	}
+	if len(misses) == 0 {
+		return values, nil
+	}
+
+	gens := make([]uint64, len(misses))
+	for i, key := range misses {
+		gens[i] = c.shard(key).generation()
+	}
+	fetched, err := c.fetchValues(ctx, misses)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, key := range misses {
+		if fetched[i] == nil {
+			continue
+		}
+		c.shard(key).putUnlessInvalidated(key, *fetched[i], gens[i])
+		for _, p := range positions[key] {
+			values[p] = fetched[i]
+		}
+	}
+	return values, nil
+}
+
+// fetchValues reads keys from the external cache along with their content
+// types and the time they have left, in one round trip. Keys it does not have
+// are nil.
+func (c *ProxyCache) fetchValues(ctx context.Context, keys []string) ([]*ValueStore, error) {
+	all := make([]string, 0, 2*len(keys))
+	all = append(all, keys...)
+	for _, key := range keys {
+		all = append(all, contentTypeKey(key))
+	}
+	items, err := c.cache.MGet(ctx, all)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]*ValueStore, len(keys))
+	for i := range keys {
+		if items[i] == nil {
+			continue
+		}
+		value := ValueStore{Value: items[i].Value, ExpiryTime: c.expiryTime(items[i].TTL)}
+		if ct := items[len(keys)+i]; ct != nil {
+			value.ContentType = decodeContentType(value.Value, ct.Value)
+		}
+		values[i] = &value
+	}
+	return values, nil
+}
+
+// HandleMSet stores many values at once, values[i] for keys[i], in the
+// external cache and then in the local one. The keys expire after ttl like
+// HandlePut. When atomically is set the external cache stores them all or
+// none. It returns the error for each key, nil if it was stored.
+//
+// The content type of a value is stored under a key of its own, which in a
+// Redis Cluster is only in the same hash slot as the value when the key has a
+// hash tag. So atomic writes of values with a content type need keys like
+// {user:42}:avatar there, or they fail with errCrossSlot.
+func (c *ProxyCache) HandleMSet(ctx context.Context, keys []string, values []ValueStore, ttl time.Duration, atomically bool) []error {
+	// values with a content type have it stored next to them, in the same
+	// batch
+	all := append([]string(nil), keys...)
+	stored := make([]string, len(values))
+	contentTypes := make(map[int]int)
+	for i, value := range values {
+		stored[i] = value.Value
+		if value.ContentType != "" {
+			contentTypes[i] = len(all)
+			all = append(all, contentTypeKey(keys[i]))
+			stored = append(stored, encodeContentType(value))
+		}
+	}
+	allErrs := c.cache.MSet(ctx, all, stored, ttl, atomically)
+	errs := allErrs[:len(keys)]
+	for i, j := range contentTypes {
+		if errs[i] == nil {
+			errs[i] = allErrs[j]
+		}
+	}
+
+	localTTL := ttl
+	if localTTL == 0 {
+		localTTL = c.externalTTL
+	}
+	// only keys the external cache has are cached, so a failed write is
+	// never served locally
+	var written []string
+	for i, key := range keys {
+		if errs[i] != nil {
+			continue
+		}
+		c.PutValue(key, values[i], localTTL)
+		written = append(written, key)
+	}
+	c.publishInvalidation(ctx, written...)
+	return errs
+}
+
+// CoalescedGets returns how many misses were answered by a fetch another
+// request made, rather than each going to the external cache
+func (c *ProxyCache) CoalescedGets() uint64 {
+	return atomic.LoadUint64(&c.coalescedGets)
+}
 
-	go c.Put(key, string(value))
+// HandlePut handles storing key and values at the local and external cache.
+// The key expires after ttl, zero means each cache uses its default.
+func (c *ProxyCache) HandlePut(ctx context.Context, key string, value string, ttl time.Duration) error {
+	return c.HandlePutValue(ctx, key, ValueStore{Value: value}, ttl)
+}
 
-	err := c.cache.Put(key, string(value))
+// HandlePutValue is HandlePut for values that may have a content type
+func (c *ProxyCache) HandlePutValue(ctx context.Context, key string, value ValueStore, ttl time.Duration) error {
+
+	var err error
+	if value.ContentType == "" {
+		err = c.cache.Put(ctx, key, value.Value, ttl)
+	} else {
+		// the content type is stored next to the value, in the same
+		// round trip
+		errs := c.cache.MSet(ctx, []string{key, contentTypeKey(key)}, []string{value.Value, encodeContentType(value)}, ttl, false)
+		err = errs[0]
+		if err == nil {
+			err = errs[1]
+		}
+	}
 	if err != nil {
 		return err
 	}
 
+	// the local copy should not outlive the one in the external cache.
+	// Only a value the external cache stored is cached, so a write that
+	// failed or was cancelled is never served locally.
+	localTTL := ttl
+	if localTTL == 0 {
+		localTTL = c.externalTTL
+	}
+	c.PutValue(key, value, localTTL)
+
+	c.publishInvalidation(ctx, key)
+
 	return nil
 
 }
 
-// NewProxyCache constructs a new ProxyCache complete with an external cache
+// HandleDelete removes the key from the external and local cache. It reports
+// whether either of them had the key.
+func (c *ProxyCache) HandleDelete(ctx context.Context, key string) (bool, error) {
+
+	// remove it from the external cache first, otherwise a miss could
+	// read it back into the local cache before it is gone. Its content type
+	// goes in the same round trip.
+	external, err := c.cache.MDelete(ctx, []string{key, contentTypeKey(key)})
+	if err != nil {
+		return false, err
+	}
+	deleted := external[0]
+
+	if c.Delete(key) {
+		deleted = true
+	}
+
+	// other proxies may still have a copy even when neither cache here did
+	c.publishInvalidation(ctx, key)
+
+	return deleted, nil
+
+}
+
+// NewProxyCache constructs a new ProxyCache complete with an external cache,
+// the one picked by config.Backend
 func NewProxyCache(config Config) *ProxyCache {
+	if config.Backend != "" && config.Backend != "redis" && config.RedisTracking != "" {
+		log.Fatal("REDIS_TRACKING needs the redis backend")
+	}
+	switch config.Backend {
+	case "memory":
+		return NewProxyCacheWithCache(config, NewMemoryCache(config.RedisTTL))
+	case "memcached":
+		// REDIS_TTL is the default lifetime of keys in any external cache
+		mc, err := NewMemcachedClient(config.RedisTTL, config.MemcachedUrl)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return NewProxyCacheWithCache(config, mc)
+	case "", "redis":
+	default:
+		log.Fatal(fmt.Sprintf("unknown backend %q", config.Backend))
+	}
+
+	if len(config.RedisClusterNodes) > 0 {
+		// keyspace events and tracking invalidations only come from the
+		// node a client is connected to, so a proxy would miss most of them
+		if config.RedisTracking != "" || config.KeyspaceNotifications {
+			log.Fatal("REDIS_TRACKING and CACHE_KEYSPACE_NOTIFICATIONS do not work with REDIS_CLUSTER_NODES")
+		}
+		rc, err := NewRedisClusterClient(config.RedisTTL, config.RedisClusterNodes)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return NewProxyCacheWithCache(config, rc)
+	}
+	if config.RedisTracking == "" {
+		rc, err := NewRedisClient(config.RedisTTL, config.RedisUrl)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return NewProxyCacheWithCache(config, rc)
+	}
+
+	// redis tells the proxy which keys to drop, so the proxy has to exist
+	// before the client
+	pc := newLocalCache(config)
+	opts := TrackingOptions{
+		Broadcast: config.RedisTracking == "bcast",
+		Prefixes:  config.RedisTrackingPrefixes,
+	}
+	rc, err := NewTrackingRedisClient(config.RedisTTL, config.RedisUrl, opts, pc.invalidateKeys)
+	if err != nil {
+		log.Fatal(err)
+	}
+	pc.unsubscribe = append(pc.unsubscribe, rc.StopTracking)
+	pc.useCache(config, rc)
+	return pc
+}
+
+// NewProxyCacheWithCache constructs a new ProxyCache in front of the given
+// external cache, any implementation of Cache will do
+func NewProxyCacheWithCache(config Config, cache Cache) *ProxyCache {
+	pc := newLocalCache(config)
+	pc.useCache(config, cache)
+	return pc
+}
+
+// useCache sets up cache as the external cache
+func (c *ProxyCache) useCache(config Config, cache Cache) {
+	c.cache = cache
+	if config.RedisTTL != nil {
+		c.externalTTL = *config.RedisTTL
+	}
+
+	// keep the local caches of all proxies consistent with each other, and
+	// with writes that do not go through a proxy
+	if config.InvalidationChannel != "" || config.KeyspaceNotifications {
+		ps, ok := cache.(PubSub)
+		if !ok {
+			log.Fatal("the external cache can not send invalidations")
+		}
+		if config.InvalidationChannel != "" {
+			if err := c.subscribeInvalidations(ps, config.InvalidationChannel); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if config.KeyspaceNotifications {
+			if err := c.subscribeKeyspace(ps); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+}
+
+// newLocalCache constructs the in-memory part of a ProxyCache, without an
+// external cache
+func newLocalCache(config Config) *ProxyCache {
 	pc := ProxyCache{
-		Data: make(map[string]ValueStore),
+		id:   newProxyID(),
+		stop: make(chan struct{}),
 	}
 
 	if config.CacheKeyCapacity != nil {
@@ -225,11 +810,165 @@ func NewProxyCache(config Config) *ProxyCache {
 
 	if config.CacheTTL != nil {
 		pc.KeyTimeout = *config.CacheTTL
-		// call method so that it can check what keys can expire
-		pc.ExpireKeys()
 	}
-	// set up external cache
-	pc.cache = NewRedisClient(config.RedisTTL, config.RedisUrl)
+
+	pc.KeyPathPrefix = config.KeyPathPrefix
+
+	shards := 1
+	if config.CacheShards != nil && *config.CacheShards > 1 {
+		shards = *config.CacheShards
+	}
+	// a shard without any capacity would have no limit at all
+	if pc.MaxKeys > 0 && shards > pc.MaxKeys {
+		shards = pc.MaxKeys
+	}
+	for i := 0; i < shards; i++ {
+		policy, err := NewEvictionPolicy(config.EvictionPolicy)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// the first MaxKeys % shards shards take one key more, so the
+		// capacities add up to MaxKeys
+		shardKeys := pc.MaxKeys / shards
+		if i < pc.MaxKeys%shards {
+			shardKeys++
+		}
+		if shardKeys != 0 {
+			// admission only matters when keys compete for a fixed capacity
+			policy, err = NewAdmissionPolicy(config.CacheAdmission, policy, shardKeys)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		pc.shards = append(pc.shards, newCacheShard(shardKeys, policy))
+	}
+	if shards == 1 {
+		pc.Data = pc.shards[0].data
+		pc.shards[0].mux = &pc.Mux
+	}
+
+	// call method so that keys are removed as they expire
+	pc.ExpireKeys()
 
 	return &pc
 }
+
+// keyEscaper escapes what would be ambiguous in a key: a slash inside a
+// segment, which is not a separator, and the % that escapes it
+var keyEscaper = strings.NewReplacer("%", "%25", "/", "%2F")
+
+// ServeHTTP routes requests for the batch routes to MGetHandler and
+// MSetHandler and every other request to PayloadHandler. Unlike http.ServeMux
+// it serves paths that are not clean instead of redirecting them, and the
+// batch routes are under KeyPathPrefix like the keys.
+func (c *ProxyCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch p, _ := c.requestPath(r); p {
+	case "_mget":
+		c.MGetHandler(w, r)
+	case "_mset":
+		c.MSetHandler(w, r)
+	default:
+		c.PayloadHandler(w, r)
+	}
+}
+
+// requestKey returns the key a request is for, which is the whole path after
+// KeyPathPrefix so keys like tenant/entity/id do not collide. The query string
+// is for options like ttl, not part of the key.
+func (c *ProxyCache) requestKey(r *http.Request) (string, bool) {
+	key, ok := c.requestPath(r)
+	if !ok || !validKey(key) {
+		return "", false
+	}
+	return key, true
+}
+
+// batchKey returns the key a batch names as key. Keys in a batch are written
+// like the path of a GET or PUT, so they are cleaned and unescaped the same way.
+func batchKey(key string) (string, bool) {
+	p, ok := cleanPath(key)
+	if !ok {
+		return "", false
+	}
+	key = strings.TrimPrefix(p, "/")
+	if !validKey(key) {
+		return "", false
+	}
+	return key, true
+}
+
+// validKey reports whether clients may use key
+func validKey(key string) bool {
+	// these are the routes for batches
+	if key == "_mget" || key == "_mset" {
+		return false
+	}
+	// the content type of a key is stored under a key with this suffix
+	if strings.HasSuffix(key, contentTypeSuffix) {
+		return false
+	}
+	return key != ""
+}
+
+// requestPath returns the cleaned path of a request after KeyPathPrefix,
+// without the leading slash
+func (c *ProxyCache) requestPath(r *http.Request) (string, bool) {
+	p, ok := cleanPath(r.URL.EscapedPath())
+	if !ok {
+		return "", false
+	}
+	prefix := path.Clean("/" + c.KeyPathPrefix)
+	if prefix != "/" {
+		if !strings.HasPrefix(p, prefix+"/") {
+			return "", false
+		}
+		p = p[len(prefix):]
+	}
+
+	return strings.TrimPrefix(p, "/"), true
+}
+
+// cleanPath cleans the escaped path p and unescapes its segments, so keys read
+// the same as over RESP and hash tags like {user:42} work, except for an
+// escaped slash (%2F) that stays part of its segment
+func cleanPath(p string) (string, bool) {
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		s, err := url.PathUnescape(segment)
+		if err != nil {
+			return "", false
+		}
+		segments[i] = keyEscaper.Replace(s)
+	}
+	return path.Clean("/" + strings.Join(segments, "/")), true
+}
+
+// requestTTL returns the ttl set for a request with a Cache-TTL header or a
+// ttl query parameter, zero if there is none
+func requestTTL(r *http.Request) (time.Duration, error) {
+	ttl := r.Header.Get("Cache-TTL")
+	if ttl == "" {
+		ttl = r.URL.Query().Get("ttl")
+	}
+	return parseTTL(ttl)
+}
+
+// parseTTL parses a ttl given with a request, either as a number of seconds
+// like the TTL env vars or as a duration like 1m30s. An empty ttl is zero.
+func parseTTL(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, serr := strconv.ParseInt(value, 10, 64)
+		if serr != nil {
+			return 0, err
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+	if ttl < 0 {
+		return 0, fmt.Errorf("negative ttl %v", value)
+	}
+	return ttl, nil
+}
@@ -1,13 +1,21 @@
 package proxy
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/cat-turner/proxy/resp"
+	"github.com/cat-turner/proxy/resp/resptest"
 	redis "github.com/go-redis/redis/v8"
 	assert "github.com/stretchr/testify/assert"
 )
@@ -20,252 +28,1361 @@ import (
 // Redis instance in order to get it into a known good state (e.g. to set keys that would be
 // read back through the proxy)
 
+// redisBackends runs test against the redis at REDIS_URL and against a fake
+// RESP server, so the scenario can also run without redis or docker
+func redisBackends(t *testing.T, test func(t *testing.T, config Config)) {
+	t.Run("redis", func(t *testing.T) {
+		config := NewConfig()
+		connectRedis(t, config.RedisUrl)
+		test(t, config)
+	})
+	t.Run("resptest", func(t *testing.T) {
+		s := resptest.NewServer()
+		defer s.Close()
+		config := NewConfig()
+		config.RedisUrl = s.Addr()
+		test(t, config)
+	})
+}
+
+// connectRedis returns a client for the redis at addr, or skips the test when
+// it can not be reached, like when the tests run without docker
+func connectRedis(t *testing.T, addr string) *redis.Client {
+	t.Helper()
+	client := redis.NewClient(&redis.Options{Addr: addr, DialTimeout: time.Second})
+	t.Cleanup(func() { client.Close() })
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		t.Skipf("redis at %s can not be reached: %v", addr, err)
+	}
+	return client
+}
+
+// newRedisProxy starts a proxy in front of the redis at config.RedisUrl and
+// returns it with a client that talks to that redis directly
+func newRedisProxy(t *testing.T, config Config) (*ProxyCache, *redis.Client) {
+	t.Helper()
+	client := connectRedis(t, config.RedisUrl)
+	proxy := NewProxyCache(config)
+	t.Cleanup(proxy.Close)
+	return proxy, client
+}
+
 func TestProxyCachedGet(t *testing.T) {
-	assert := assert.New(t)
+	redisBackends(t, func(t *testing.T, config Config) {
+		assert := assert.New(t)
 
-	// some constants to start with
-	duration, _ := time.ParseDuration("10s")
+		// some constants to start with
+		duration, _ := time.ParseDuration("10s")
 
-	config := NewConfig()
-	config.CacheTTL = &duration
+		config.CacheTTL = &duration
 
-	proxy := NewProxyCache(config)
+		proxy, redisClient := newRedisProxy(t, config)
 
-	var ctx = context.Background()
-	redisClient := redis.NewClient(&redis.Options{
-		Addr:     config.RedisUrl,
-		Password: "", // no password set
-		DB:       0,  // use default DB
-	})
-	// redis client that should be running
-	_, err := redisClient.Ping(ctx).Result()
-	assert.NoError(err)
+		var ctx = context.Background()
 
-	// get rid of value for test
-	redisClient.Del(ctx, "roxi")
-	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(proxy.PayloadHandler)
+		// get rid of value for test
+		redisClient.Del(ctx, "roxi")
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(proxy.PayloadHandler)
 
-	// Requirement: HTTP web service
+		// Requirement: HTTP web service
 
-	// test that calling get on empty cache will return nothing
-	req, _ := http.NewRequest("GET", "/roxi", nil)
-	handler.ServeHTTP(rr, req)
-	assert.Equal(http.StatusNotFound, rr.Code)
+		// test that calling get on empty cache will return nothing
+		req, _ := http.NewRequest("GET", "/roxi", nil)
+		handler.ServeHTTP(rr, req)
+		assert.Equal(http.StatusNotFound, rr.Code)
 
-	// set a value through the redis client and confirm you are able to pick it up
-	// using the proxy
-	// note this is using the redis client from the module and not proxy
-	err = redisClient.Set(ctx, "roxi", "rocks", 0).Err()
-	assert.NoError(err)
+		// set a value through the redis client and confirm you are able to pick it up
+		// using the proxy
+		// note this is using the redis client from the module and not proxy
+		err := redisClient.Set(ctx, "roxi", "rocks", 0).Err()
+		assert.NoError(err)
 
-	rrAfterSet := httptest.NewRecorder()
-	handler.ServeHTTP(rrAfterSet, req)
-	assert.Equal(http.StatusOK, rrAfterSet.Code)
-	assert.Equal(`{"roxi": "rocks"}`, rrAfterSet.Body.String())
-
-	// Requirement: Cached GET
-	// verify that map has value
-	// this shows that the value is stored in the proxy cache
-	// sleep to avoid test failure due to data race condition
-	time.Sleep(2 * time.Second)
-	assert.Equal("rocks", proxy.Data["roxi"].Value)
-
-	// set the value again directly on redis to something else
-	// this shows that the proxy is getting its value from the local cache
-	// and not redis
-	err = redisClient.Set(ctx, "roxi", "cute", 0).Err()
-	assert.NoError(err)
+		rrAfterSet := httptest.NewRecorder()
+		handler.ServeHTTP(rrAfterSet, req)
+		assert.Equal(http.StatusOK, rrAfterSet.Code)
+		assert.Equal(`{"key":"roxi","value":"rocks"}`, rrAfterSet.Body.String())
 
-	rrAfterSecondSet := httptest.NewRecorder()
-	handler.ServeHTTP(rrAfterSecondSet, req)
-	assert.Equal(http.StatusOK, rrAfterSecondSet.Code)
-	assert.Equal(`{"roxi": "rocks"}`, rrAfterSecondSet.Body.String())
+		// Requirement: Cached GET
+		// verify that map has value
+		// this shows that the value is stored in the proxy cache
+		// sleep to avoid test failure due to data race condition
+		time.Sleep(2 * time.Second)
+		cached, _ := proxy.Peek("roxi")
+		assert.Equal("rocks", cached.Value)
 
-	// Requirement: Single backing instance
-	// create another proxy and confirm that the value you get from it is the new value
-	proxy2 := NewProxyCache(config)
-	handler2 := http.HandlerFunc(proxy2.PayloadHandler)
-	rr2 := httptest.NewRecorder()
-	handler2.ServeHTTP(rr2, req)
-	assert.Equal(http.StatusOK, rr2.Code)
-	assert.Equal(`{"roxi": "cute"}`, rr2.Body.String())
-	time.Sleep(2 * time.Second)
-	assert.Equal("cute", proxy2.Data["roxi"].Value)
-	// verify other is clearly same
-	assert.Equal(proxy.Data["roxi"].Value, "rocks")
+		// set the value again directly on redis to something else
+		// this shows that the proxy is getting its value from the local cache
+		// and not redis
+		err = redisClient.Set(ctx, "roxi", "cute", 0).Err()
+		assert.NoError(err)
+
+		rrAfterSecondSet := httptest.NewRecorder()
+		handler.ServeHTTP(rrAfterSecondSet, req)
+		assert.Equal(http.StatusOK, rrAfterSecondSet.Code)
+		assert.Equal(`{"key":"roxi","value":"rocks"}`, rrAfterSecondSet.Body.String())
+
+		// Requirement: Single backing instance
+		// create another proxy and confirm that the value you get from it is the new value
+		proxy2 := NewProxyCache(config)
+		t.Cleanup(proxy2.Close)
+		handler2 := http.HandlerFunc(proxy2.PayloadHandler)
+		rr2 := httptest.NewRecorder()
+		handler2.ServeHTTP(rr2, req)
+		assert.Equal(http.StatusOK, rr2.Code)
+		assert.Equal(`{"key":"roxi","value":"cute"}`, rr2.Body.String())
+		time.Sleep(2 * time.Second)
+		cached2, _ := proxy2.Peek("roxi")
+		assert.Equal("cute", cached2.Value)
+		// verify other is clearly same
+		cached, _ = proxy.Peek("roxi")
+		assert.Equal(cached.Value, "rocks")
+	})
 }
 
 func TestGlobalExpiry(t *testing.T) {
+	redisBackends(t, func(t *testing.T, config Config) {
+		assert := assert.New(t)
+		// Entries expire after some time that is globally configured in all proxy instances
+		// this does not seem to apply to redis because it specifically mentions the proxy cache
+
+		// mimic time passage
+
+		// some constants to start with 1 sec ttl
+		duration, _ := time.ParseDuration("1s")
+
+		config.CacheTTL = &duration
+
+		// set up a few instances
+		proxy1, redisClient := newRedisProxy(t, config)
+		proxy2 := NewProxyCache(config)
+		t.Cleanup(proxy2.Close)
+
+		var ctx = context.Background()
+
+		// get rid of value for test
+		redisClient.Del(ctx, "tita")
+		//rr := httptest.NewRecorder()
+		handler1 := http.HandlerFunc(proxy1.PayloadHandler)
+		handler2 := http.HandlerFunc(proxy2.PayloadHandler)
+
+		// set value in redis
+		err := redisClient.Set(ctx, "tita", "is cool", 0).Err()
+		assert.NoError(err)
+
+		// issue get request at the same time and verify the value is correct
+		req, _ := http.NewRequest("GET", "/tita", nil)
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			rr1 := httptest.NewRecorder()
+			handler1.ServeHTTP(rr1, req)
+			assert.Equal(`{"key":"tita","value":"is cool"}`, rr1.Body.String())
+		}()
+		go func() {
+			defer wg.Done()
+			rr2 := httptest.NewRecorder()
+			handler2.ServeHTTP(rr2, req)
+			assert.Equal(`{"key":"tita","value":"is cool"}`, rr2.Body.String())
+		}()
+
+		wg.Wait()
+		// let time pass for tokens to expire
+		time.Sleep(2 * time.Second)
+		// set value in redis to new value
+		err = redisClient.Set(ctx, "tita", "is fire", 0).Err()
+		assert.NoError(err)
+
+		// issue get request and verify the value is  new value
+		//After an entry is expired, a GET request will
+		//act as if the value associated with the key was never stored in the cache.
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			rr1 := httptest.NewRecorder()
+			handler1.ServeHTTP(rr1, req)
+			assert.Equal(`{"key":"tita","value":"is fire"}`, rr1.Body.String())
+		}()
+		go func() {
+			defer wg.Done()
+			rr2 := httptest.NewRecorder()
+			handler2.ServeHTTP(rr2, req)
+			assert.Equal(`{"key":"tita","value":"is fire"}`, rr2.Body.String())
+		}()
+
+		wg.Wait()
+	})
+}
+
+func TestLRUEvictionFixedKeySize(t *testing.T) {
+	redisBackends(t, func(t *testing.T, config Config) {
+		assert := assert.New(t)
+
+		// some constants to start with
+		duration, _ := time.ParseDuration("1s")
+
+		config.CacheTTL = &duration
+		only2 := 2
+		config.CacheKeyCapacity = &only2
+
+		proxy, redisClient := newRedisProxy(t, config)
+
+		var ctx = context.Background()
+
+		// get rid of values for test
+		redisClient.Del(ctx, "rocco")
+		redisClient.Del(ctx, "heff")
+		redisClient.Del(ctx, "tito")
+		// set values in redis
+		err := redisClient.Set(ctx, "rocco", "wow", 0).Err()
+		assert.NoError(err)
+		err = redisClient.Set(ctx, "heff", "zao", 0).Err()
+		assert.NoError(err)
+		err = redisClient.Set(ctx, "tito", "pow", 0).Err()
+		assert.NoError(err)
+
+		handler := http.HandlerFunc(proxy.PayloadHandler)
+
+		// Requirement: LRU eviction
+		// fetch data through the proxy
+
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/rocco", nil)
+		handler.ServeHTTP(rr, req)
+		assert.Equal(rr.Code, http.StatusOK)
+		assert.Equal(rr.Body.String(), `{"key":"rocco","value":"wow"}`)
+
+		req, _ = http.NewRequest("GET", "/heff", nil)
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(rr.Code, http.StatusOK)
+		assert.Equal(rr.Body.String(), `{"key":"heff","value":"zao"}`)
+		time.Sleep(2 * time.Second)
+		req, _ = http.NewRequest("GET", "/heff", nil)
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(rr.Code, http.StatusOK)
+		assert.Equal(rr.Body.String(), `{"key":"heff","value":"zao"}`)
+
+		// this third call should displace data rocco
+		req, _ = http.NewRequest("GET", "/tito", nil)
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(rr.Code, http.StatusOK)
+		assert.Equal(rr.Body.String(), `{"key":"tito","value":"pow"}`)
+
+		// we should still have this data
+		req, _ = http.NewRequest("GET", "/heff", nil)
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(rr.Code, http.StatusOK)
+		assert.Equal(rr.Body.String(), `{"key":"heff","value":"zao"}`)
+
+		// and the third data should be empty
+		// delete from redis backing to make results clear
+		redisClient.Del(ctx, "rocco")
+		rr = httptest.NewRecorder()
+		req, _ = http.NewRequest("GET", "/rocco", nil)
+		handler.ServeHTTP(rr, req)
+		assert.Equal(rr.Code, http.StatusNotFound)
+		_, ok := proxy.Peek("rocco")
+		assert.False(ok)
+
+		_, ok2 := proxy.Peek("tito")
+		assert.True(ok2)
+		_, ok3 := proxy.Peek("heff")
+		assert.True(ok3)
+
+		//Requirement: Fixed key size
+		assert.Equal(proxy.Len(), 2)
+	})
+}
+
+func TestLRUEvictionOrder(t *testing.T) {
 	assert := assert.New(t)
-	// Entries expire after some time that is globally configured in all proxy instances
-	// this does not seem to apply to redis because it specifically mentions the proxy cache
 
-	// mimic time passage
+	// the local cache on its own, no redis needed
+	only3 := 3
+	proxy := newLocalCache(Config{CacheKeyCapacity: &only3})
+	t.Cleanup(proxy.Close)
 
-	// some constants to start with 1 sec ttl
-	duration, _ := time.ParseDuration("1s")
+	proxy.Put("rocco", "wow")
+	proxy.Put("heff", "zao")
+	proxy.Put("tito", "pow")
 
-	config := NewConfig()
-	config.CacheTTL = &duration
+	// reading rocco and writing heff again makes tito the least recently used
+	assert.Equal("wow", *proxy.Get("rocco"))
+	proxy.Put("heff", "zing")
 
-	// set up a few instances
-	proxy1 := NewProxyCache(config)
-	proxy2 := NewProxyCache(config)
+	proxy.Put("roxi", "rocks")
+	assert.Nil(proxy.Get("tito"))
+	assert.Equal("zing", *proxy.Get("heff"))
 
-	var ctx = context.Background()
-	redisClient := redis.NewClient(&redis.Options{
-		Addr:     config.RedisUrl,
-		Password: "", // no password set
-		DB:       0,  // use default DB
+	proxy.Put("tita", "is cool")
+	assert.Nil(proxy.Get("rocco"))
+	assert.Equal(3, proxy.Len())
+}
+
+func BenchmarkPutAtCapacity(b *testing.B) {
+	capacity := 100000
+	proxy := newLocalCache(Config{CacheKeyCapacity: &capacity})
+	b.Cleanup(proxy.Close)
+	for i := 0; i < proxy.MaxKeys; i++ {
+		proxy.Put(strconv.Itoa(i), "value")
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		proxy.Put(strconv.Itoa(proxy.MaxKeys+i), "value")
+	}
+}
+
+func TestRedisTTLCapsLocalExpiry(t *testing.T) {
+	redisBackends(t, func(t *testing.T, config Config) {
+		assert := assert.New(t)
+
+		duration, _ := time.ParseDuration("10s")
+
+		config.CacheTTL = &duration
+
+		proxy, redisClient := newRedisProxy(t, config)
+
+		var ctx = context.Background()
+
+		// the key has a lot less time left in redis than CACHE_TTL
+		err := redisClient.Set(ctx, "bobo", "naps", time.Second).Err()
+		assert.NoError(err)
+
+		handler := http.HandlerFunc(proxy.PayloadHandler)
+		req, _ := http.NewRequest("GET", "/bobo", nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(http.StatusOK, rr.Code)
+
+		cached, ok := proxy.Peek("bobo")
+		assert.True(ok)
+		assert.True(cached.ExpiryTime.Before(time.Now().Add(time.Second)))
+
+		// once redis has expired the key so has the proxy
+		time.Sleep(1100 * time.Millisecond)
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(http.StatusNotFound, rr.Code)
 	})
-	// redis client that should be running
-	_, err := redisClient.Ping(ctx).Result()
-	assert.NoError(err)
+}
 
-	// get rid of value for test
-	redisClient.Del(ctx, "tita")
-	//rr := httptest.NewRecorder()
-	handler1 := http.HandlerFunc(proxy1.PayloadHandler)
-	handler2 := http.HandlerFunc(proxy2.PayloadHandler)
+func TestPutWithTTLFromRequest(t *testing.T) {
+	redisBackends(t, func(t *testing.T, config Config) {
+		assert := assert.New(t)
 
-	// set value in redis
-	err = redisClient.Set(ctx, "tita", "is cool", 0).Err()
+		duration, _ := time.ParseDuration("10s")
+
+		config.CacheTTL = &duration
+
+		proxy, redisClient := newRedisProxy(t, config)
+
+		var ctx = context.Background()
+		redisClient.Del(ctx, "session", "config")
+
+		handler := http.HandlerFunc(proxy.PayloadHandler)
+
+		// a short lived session token set with the header
+		req, _ := http.NewRequest("PUT", "/session", strings.NewReader("abc123"))
+		req.Header.Set("Cache-TTL", "2")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(http.StatusOK, rr.Code)
+
+		// a config blob set with the query parameter, the query string is not
+		// part of the key
+		req, _ = http.NewRequest("PUT", "/config?ttl=1m", strings.NewReader("{}"))
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(http.StatusOK, rr.Code)
+
+		ttl, err := redisClient.PTTL(ctx, "session").Result()
+		assert.NoError(err)
+		assert.InDelta(2*time.Second, ttl, float64(100*time.Millisecond))
+		ttl, err = redisClient.PTTL(ctx, "config").Result()
+		assert.NoError(err)
+		assert.InDelta(time.Minute, ttl, float64(100*time.Millisecond))
+
+		// locally the session goes away with redis and the config blob is
+		// still capped by CACHE_TTL
+		time.Sleep(100 * time.Millisecond)
+		session, _ := proxy.Peek("session")
+		assert.WithinDuration(time.Now().Add(2*time.Second), session.ExpiryTime, 200*time.Millisecond)
+		blob, _ := proxy.Peek("config")
+		assert.WithinDuration(time.Now().Add(10*time.Second), blob.ExpiryTime, 200*time.Millisecond)
+
+		req, _ = http.NewRequest("PUT", "/session?ttl=soon", strings.NewReader("abc123"))
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(http.StatusBadRequest, rr.Code)
+	})
+}
+
+func TestParseTTL(t *testing.T) {
+	assert := assert.New(t)
+
+	ttl, err := parseTTL("")
 	assert.NoError(err)
+	assert.Equal(time.Duration(0), ttl)
 
-	// issue get request at the same time and verify the value is correct
-	req, _ := http.NewRequest("GET", "/tita", nil)
-
-	var wg sync.WaitGroup
-	wg.Add(2)
-	go func() {
-		defer wg.Done()
-		rr1 := httptest.NewRecorder()
-		handler1.ServeHTTP(rr1, req)
-		assert.Equal(`{"tita": "is cool"}`, rr1.Body.String())
-	}()
-	go func() {
-		defer wg.Done()
-		rr2 := httptest.NewRecorder()
-		handler2.ServeHTTP(rr2, req)
-		assert.Equal(`{"tita": "is cool"}`, rr2.Body.String())
-	}()
+	ttl, err = parseTTL("30")
+	assert.NoError(err)
+	assert.Equal(30*time.Second, ttl)
 
-	wg.Wait()
-	// let time pass for tokens to expire
-	time.Sleep(2 * time.Second)
-	// set value in redis to new value
-	err = redisClient.Set(ctx, "tita", "is fire", 0).Err()
+	ttl, err = parseTTL("1m30s")
 	assert.NoError(err)
+	assert.Equal(90*time.Second, ttl)
 
-	// issue get request and verify the value is  new value
-	//After an entry is expired, a GET request will
-	//act as if the value associated with the key was never stored in the cache.
-	wg.Add(2)
-	go func() {
-		defer wg.Done()
-		rr1 := httptest.NewRecorder()
-		handler1.ServeHTTP(rr1, req)
-		assert.Equal(`{"tita": "is fire"}`, rr1.Body.String())
-	}()
-	go func() {
-		defer wg.Done()
-		rr2 := httptest.NewRecorder()
-		handler2.ServeHTTP(rr2, req)
-		assert.Equal(`{"tita": "is fire"}`, rr2.Body.String())
-	}()
+	_, err = parseTTL("-5s")
+	assert.Error(err)
+	_, err = parseTTL("soon")
+	assert.Error(err)
+}
+
+func TestProxyDelete(t *testing.T) {
+	redisBackends(t, func(t *testing.T, config Config) {
+		assert := assert.New(t)
+
+		proxy, redisClient := newRedisProxy(t, config)
+
+		var ctx = context.Background()
+		redisClient.Del(ctx, "roxi")
 
-	wg.Wait()
+		handler := http.HandlerFunc(proxy.PayloadHandler)
 
+		req, _ := http.NewRequest("PUT", "/roxi", strings.NewReader("rocks"))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(http.StatusOK, rr.Code)
+
+		// the key goes from both caches
+		req, _ = http.NewRequest("DELETE", "/roxi", nil)
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(http.StatusOK, rr.Code)
+		assert.Equal(`{"key":"roxi","deleted":true}`, rr.Body.String())
+
+		_, ok := proxy.Peek("roxi")
+		assert.False(ok)
+		_, err := redisClient.Get(ctx, "roxi").Result()
+		assert.Equal(redis.Nil, err)
+
+		req, _ = http.NewRequest("GET", "/roxi", nil)
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(http.StatusNotFound, rr.Code)
+
+		// deleting it again finds nothing
+		req, _ = http.NewRequest("DELETE", "/roxi", nil)
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(http.StatusNotFound, rr.Code)
+	})
 }
 
-func TestLRUEvictionFixedKeySize(t *testing.T) {
+func TestInvalidationAcrossProxies(t *testing.T) {
+	redisBackends(t, func(t *testing.T, config Config) {
+		assert := assert.New(t)
+
+		duration, _ := time.ParseDuration("10s")
+
+		config.CacheTTL = &duration
+		config.InvalidationChannel = "proxy:test:invalidations"
+
+		proxy1, redisClient := newRedisProxy(t, config)
+		proxy2 := NewProxyCache(config)
+		defer proxy2.Close()
+
+		var ctx = context.Background()
+
+		err := redisClient.Set(ctx, "tita", "is cool", 0).Err()
+		assert.NoError(err)
+
+		// both proxies have the key cached
+		for _, p := range []*ProxyCache{proxy1, proxy2} {
+			value, err := p.HandleGet(ctx, "tita")
+			assert.NoError(err)
+			assert.Equal("is cool", *value)
+		}
+
+		// a write through one proxy drops the copy the other one has, long
+		// before CACHE_TTL
+		err = proxy1.HandlePut(ctx, "tita", "is fire", 0)
+		assert.NoError(err)
+		assert.Eventually(func() bool {
+			_, ok := proxy2.Peek("tita")
+			return !ok
+		}, time.Second, 10*time.Millisecond)
+		value, err := proxy2.HandleGet(ctx, "tita")
+		assert.NoError(err)
+		assert.Equal("is fire", *value)
+
+		// the proxy that wrote the key keeps its own copy
+		cached, ok := proxy1.Peek("tita")
+		assert.True(ok)
+		assert.Equal("is fire", cached.Value)
+
+		// and so do deletes
+		_, err = proxy2.HandleDelete(ctx, "tita")
+		assert.NoError(err)
+		assert.Eventually(func() bool {
+			_, ok := proxy1.Peek("tita")
+			return !ok
+		}, time.Second, 10*time.Millisecond)
+	})
+}
+
+func TestKeyspaceNotifications(t *testing.T) {
 	assert := assert.New(t)
 
-	// some constants to start with
-	duration, _ := time.ParseDuration("1s")
+	duration, _ := time.ParseDuration("10s")
 
 	config := NewConfig()
 	config.CacheTTL = &duration
-	only2 := 2
-	config.CacheKeyCapacity = &only2
+	config.KeyspaceNotifications = true
+
+	var ctx = context.Background()
+	redisClient := connectRedis(t, config.RedisUrl)
+	// redis does not send notifications unless it is told to
+	err := redisClient.ConfigSet(ctx, "notify-keyspace-events", "K$gxe").Err()
+	assert.NoError(err)
 
 	proxy := NewProxyCache(config)
+	defer proxy.Close()
 
-	var ctx = context.Background()
-	redisClient := redis.NewClient(&redis.Options{
-		Addr:     config.RedisUrl,
-		Password: "", // no password set
-		DB:       0,  // use default DB
-	})
-	// redis client that should be running
-	_, err := redisClient.Ping(ctx).Result()
+	err = redisClient.Set(ctx, "tita", "is cool", 0).Err()
+	assert.NoError(err)
+	value, err := proxy.HandleGet(ctx, "tita")
 	assert.NoError(err)
+	assert.Equal("is cool", *value)
 
-	// get rid of values for test
-	redisClient.Del(ctx, "rocco")
-	redisClient.Del(ctx, "heff")
-	redisClient.Del(ctx, "tito")
-	// set values in redis
-	err = redisClient.Set(ctx, "rocco", "wow", 0).Err()
+	// another service writes to redis without going through the proxy
+	err = redisClient.Set(ctx, "tita", "is fire", 0).Err()
+	assert.NoError(err)
+	assert.Eventually(func() bool {
+		_, ok := proxy.Peek("tita")
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+	value, err = proxy.HandleGet(ctx, "tita")
 	assert.NoError(err)
-	err = redisClient.Set(ctx, "heff", "zao", 0).Err()
+	assert.Equal("is fire", *value)
+
+	err = redisClient.Del(ctx, "tita").Err()
 	assert.NoError(err)
-	err = redisClient.Set(ctx, "tito", "pow", 0).Err()
+	assert.Eventually(func() bool {
+		_, ok := proxy.Peek("tita")
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+	value, err = proxy.HandleGet(ctx, "tita")
 	assert.NoError(err)
+	assert.Nil(value)
+}
+
+func TestClientTracking(t *testing.T) {
+	for _, mode := range []string{"default", "bcast"} {
+		t.Run(mode, func(t *testing.T) {
+			assert := assert.New(t)
+
+			duration, _ := time.ParseDuration("10s")
+
+			config := NewConfig()
+			config.CacheTTL = &duration
+			config.RedisTracking = mode
+			config.RedisTrackingPrefixes = []string{"user:"}
+
+			proxy, redisClient := newRedisProxy(t, config)
+
+			var ctx = context.Background()
+
+			err := redisClient.Set(ctx, "user:42", "roxi", 0).Err()
+			assert.NoError(err)
+			value, err := proxy.HandleGet(ctx, "user:42")
+			assert.NoError(err)
+			assert.Equal("roxi", *value)
+
+			// redis tells the proxy as soon as the key changes
+			err = redisClient.Set(ctx, "user:42", "tita", 0).Err()
+			assert.NoError(err)
+			assert.Eventually(func() bool {
+				_, ok := proxy.Peek("user:42")
+				return !ok
+			}, time.Second, 10*time.Millisecond)
+			value, err = proxy.HandleGet(ctx, "user:42")
+			assert.NoError(err)
+			assert.Equal("tita", *value)
+
+			err = redisClient.Del(ctx, "user:42").Err()
+			assert.NoError(err)
+			assert.Eventually(func() bool {
+				_, ok := proxy.Peek("user:42")
+				return !ok
+			}, time.Second, 10*time.Millisecond)
+
+			if mode == "default" {
+				// the proxy's own writes are not reported back to it,
+				// so its copy stays
+				err = redisClient.Set(ctx, "user:42", "roxi", 0).Err()
+				assert.NoError(err)
+				value, err = proxy.HandleGet(ctx, "user:42")
+				assert.NoError(err)
+				assert.Equal("roxi", *value)
+				err = proxy.HandlePut(ctx, "user:42", "heff", 0)
+				assert.NoError(err)
+				time.Sleep(50 * time.Millisecond)
+				heff, ok := proxy.Peek("user:42")
+				assert.True(ok)
+				assert.Equal("heff", heff.Value)
+			}
+
+			// closing twice is fine
+			assert.NoError(proxy.cache.(RedisClient).StopTracking())
+			assert.NoError(proxy.cache.(RedisClient).StopTracking())
+		})
+	}
+}
+
+func TestJSONResponses(t *testing.T) {
+	redisBackends(t, func(t *testing.T, config Config) {
+		assert := assert.New(t)
+
+		proxy, redisClient := newRedisProxy(t, config)
+
+		var ctx = context.Background()
+
+		handler := http.HandlerFunc(proxy.PayloadHandler)
+
+		hostile := []struct {
+			path  string
+			key   string
+			value string
+		}{
+			{"/quote", "quote", `she said "hi"`},
+			{"/%22roxi%5C", `"roxi\`, `C:\temp\`},
+			{"/newline", "newline", "line one\nline two\r\n\ttabbed"},
+			{"/empty", "empty", ""},
+			{"/html", "html", `</script><script>alert(1)</script>&`},
+			{"/caf%C3%A9", "café", "\u2028☕\x00"},
+			{"/brace", "brace", `{"key": "not really"}`},
+		}
+		for _, h := range hostile {
+			redisClient.Del(ctx, h.key)
+
+			req, _ := http.NewRequest("PUT", h.path, strings.NewReader(h.value))
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			assert.Equal(http.StatusOK, rr.Code)
+			assert.Equal("application/json", rr.Header().Get("Content-Type"))
+			var put response
+			assert.NoError(json.Unmarshal(rr.Body.Bytes(), &put), rr.Body.String())
+			assert.Equal(h.key, put.Key)
+			assert.Equal(h.value, *put.Value)
+
+			req, _ = http.NewRequest("GET", h.path, nil)
+			rr = httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			assert.Equal(http.StatusOK, rr.Code)
+			var got response
+			assert.NoError(json.Unmarshal(rr.Body.Bytes(), &got), rr.Body.String())
+			assert.Equal(h.key, got.Key)
+			assert.Equal(h.value, *got.Value)
+		}
+
+		// errors use the same envelope
+		req, _ := http.NewRequest("GET", "/nobody-has-this", nil)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(http.StatusNotFound, rr.Code)
+		assert.Equal(`{"error":"not found"}`, rr.Body.String())
+
+		req, _ = http.NewRequest("POST", "/quote", nil)
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(http.StatusMethodNotAllowed, rr.Code)
+		assert.Equal(`{"error":"method not allowed"}`, rr.Body.String())
+	})
+}
+
+func TestRawValues(t *testing.T) {
+	redisBackends(t, func(t *testing.T, config Config) {
+		assert := assert.New(t)
+
+		proxy, redisClient := newRedisProxy(t, config)
+
+		var ctx = context.Background()
+		redisClient.Del(ctx, "logo", "logo:content-type", "plain")
+
+		handler := http.HandlerFunc(proxy.PayloadHandler)
+
+		png := "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\xff\xfe"
+		req, _ := http.NewRequest("PUT", "/logo", strings.NewReader(png))
+		req.Header.Set("Content-Type", "image/png")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(http.StatusOK, rr.Code)
+
+		// the bytes come back as they were sent, from the local cache and
+		// from redis
+		other := NewProxyCache(config)
+		t.Cleanup(other.Close)
+		for _, p := range []*ProxyCache{proxy, other} {
+			handler := http.HandlerFunc(p.PayloadHandler)
+
+			req, _ = http.NewRequest("GET", "/logo?raw=1", nil)
+			rr = httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			assert.Equal(http.StatusOK, rr.Code)
+			assert.Equal("image/png", rr.Header().Get("Content-Type"))
+			assert.Equal(png, rr.Body.String())
+
+			req, _ = http.NewRequest("GET", "/logo", nil)
+			req.Header.Set("Accept", "image/webp,image/*;q=0.8")
+			rr = httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			assert.Equal("image/png", rr.Header().Get("Content-Type"))
+			assert.Equal(png, rr.Body.String())
+
+			// otherwise the content type is part of the JSON
+			req, _ = http.NewRequest("GET", "/logo", nil)
+			req.Header.Set("Accept", "*/*")
+			rr = httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			assert.Equal("application/json", rr.Header().Get("Content-Type"))
+			var got response
+			assert.NoError(json.Unmarshal(rr.Body.Bytes(), &got))
+			assert.Equal("image/png", got.ContentType)
+		}
 
-	handler := http.HandlerFunc(proxy.PayloadHandler)
+		// redis has the bytes as they were sent, the content type is next to
+		// them
+		stored, err := redisClient.Get(ctx, "logo").Result()
+		assert.NoError(err)
+		assert.Equal(png, stored)
+		n, err := redisClient.Exists(ctx, "logo:content-type").Result()
+		assert.NoError(err)
+		assert.Equal(int64(1), n)
 
-	// Requirement: LRU eviction
-	// fetch data through the proxy
+		// a value replaced by another client does not take the content type
+		err = redisClient.Set(ctx, "logo", "not a png", 0).Err()
+		assert.NoError(err)
+		third := NewProxyCache(config)
+		defer third.Close()
+		req, _ = http.NewRequest("GET", "/logo?raw=1", nil)
+		rr = httptest.NewRecorder()
+		http.HandlerFunc(third.PayloadHandler).ServeHTTP(rr, req)
+		assert.Equal("application/octet-stream", rr.Header().Get("Content-Type"))
+		assert.Equal("not a png", rr.Body.String())
 
+		// deleting the key deletes its content type
+		req, _ = http.NewRequest("DELETE", "/logo", nil)
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(http.StatusOK, rr.Code)
+		n, err = redisClient.Exists(ctx, "logo:content-type").Result()
+		assert.NoError(err)
+		assert.Equal(int64(0), n)
+
+		req, _ = http.NewRequest("GET", "/logo:content-type", nil)
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(http.StatusBadRequest, rr.Code)
+
+		// values written straight to redis have no content type
+		err = redisClient.Set(ctx, "plain", "just text", 0).Err()
+		assert.NoError(err)
+		req, _ = http.NewRequest("GET", "/plain?raw=true", nil)
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal("application/octet-stream", rr.Header().Get("Content-Type"))
+		assert.Equal("just text", rr.Body.String())
+	})
+}
+
+func TestBinaryValues(t *testing.T) {
+	assert := assert.New(t)
+
+	proxy := NewProxyCacheWithCache(Config{}, NewMemoryCache(nil))
+	defer proxy.Close()
+	binary := "\xff\xfe\x00roxi"
+
+	// JSON only holds UTF-8, so other values are sent as base64
+	req, _ := http.NewRequest("PUT", "/bin", strings.NewReader(binary))
 	rr := httptest.NewRecorder()
-	req, _ := http.NewRequest("GET", "/rocco", nil)
-	handler.ServeHTTP(rr, req)
-	assert.Equal(rr.Code, http.StatusOK)
-	assert.Equal(rr.Body.String(), `{"rocco": "wow"}`)
+	proxy.ServeHTTP(rr, req)
+	assert.Equal(`{"key":"bin","value":"//4Acm94aQ==","encoding":"base64"}`, rr.Body.String())
 
-	req, _ = http.NewRequest("GET", "/heff", nil)
+	req, _ = http.NewRequest("GET", "/bin", nil)
 	rr = httptest.NewRecorder()
-	handler.ServeHTTP(rr, req)
-	assert.Equal(rr.Code, http.StatusOK)
-	assert.Equal(rr.Body.String(), `{"heff": "zao"}`)
-	time.Sleep(2 * time.Second)
-	req, _ = http.NewRequest("GET", "/heff", nil)
+	proxy.ServeHTTP(rr, req)
+	var got response
+	assert.NoError(json.Unmarshal(rr.Body.Bytes(), &got))
+	assert.Equal("base64", got.Encoding)
+	value, err := base64.StdEncoding.DecodeString(*got.Value)
+	assert.NoError(err)
+	assert.Equal(binary, string(value))
+
+	req, _ = http.NewRequest("GET", "/bin?raw=1", nil)
 	rr = httptest.NewRecorder()
-	handler.ServeHTTP(rr, req)
-	assert.Equal(rr.Code, http.StatusOK)
-	assert.Equal(rr.Body.String(), `{"heff": "zao"}`)
+	proxy.ServeHTTP(rr, req)
+	assert.Equal(binary, rr.Body.String())
 
-	// this third call should displace data rocco
-	req, _ = http.NewRequest("GET", "/tito", nil)
+	req, _ = http.NewRequest("POST", "/_mset", strings.NewReader(`{"text": "is fire"}`))
+	rr = httptest.NewRecorder()
+	proxy.ServeHTTP(rr, req)
+	req, _ = http.NewRequest("POST", "/_mget", strings.NewReader(`["bin", "text"]`))
 	rr = httptest.NewRecorder()
+	proxy.ServeHTTP(rr, req)
+	assert.Equal(`{"values":{"bin":"//4Acm94aQ==","text":"is fire"},"encodings":{"bin":"base64"}}`, rr.Body.String())
+}
+
+func TestContentTypeEncoding(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("users/42:content-type", contentTypeKey("users/42"))
+	for _, v := range []ValueStore{
+		{Value: "rocks", ContentType: "text/plain; charset=utf-8"},
+		{Value: "", ContentType: "application/octet-stream"},
+		{Value: "line\none\n", ContentType: "text/csv"},
+	} {
+		assert.Equal(v.ContentType, decodeContentType(v.Value, encodeContentType(v)))
+	}
+
+	// a content type stored for another value is not used
+	stored := encodeContentType(ValueStore{Value: "rocks", ContentType: "text/plain"})
+	assert.Equal("", decodeContentType("rolls", stored))
+	assert.Equal("", decodeContentType("rocks", "text/plain"))
+}
+
+func TestMGet(t *testing.T) {
+	redisBackends(t, func(t *testing.T, config Config) {
+		assert := assert.New(t)
+
+		duration, _ := time.ParseDuration("10s")
+
+		config.CacheTTL = &duration
+		proxy, redisClient := newRedisProxy(t, config)
+
+		var ctx = context.Background()
+		redisClient.Del(ctx, "roxi", "tita", "heff", "nobody")
+
+		// one key is already in the local cache, the others are only in redis
+		err := redisClient.Set(ctx, "roxi", "rocks", 0).Err()
+		assert.NoError(err)
+		proxy.Put("roxi", "rocks locally")
+		err = redisClient.Set(ctx, "tita", "is cool", 0).Err()
+		assert.NoError(err)
+		err = redisClient.Set(ctx, "heff", "zao", 2*time.Second).Err()
+		assert.NoError(err)
+
+		handler := http.HandlerFunc(proxy.MGetHandler)
+
+		req, _ := http.NewRequest("POST", "/_mget", strings.NewReader(`["roxi", "tita", "heff", "nobody", "tita"]`))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(http.StatusOK, rr.Code)
+		assert.Equal(`{"values":{"heff":"zao","nobody":null,"roxi":"rocks locally","tita":"is cool"}}`, rr.Body.String())
+
+		// the misses are now cached, for no longer than redis keeps them
+		tita, ok := proxy.Peek("tita")
+		assert.True(ok)
+		assert.Equal("is cool", tita.Value)
+		heff, ok := proxy.Peek("heff")
+		assert.True(ok)
+		assert.WithinDuration(time.Now().Add(2*time.Second), heff.ExpiryTime, 200*time.Millisecond)
+		_, ok = proxy.Peek("nobody")
+		assert.False(ok)
+
+		req, _ = http.NewRequest("POST", "/_mget", strings.NewReader(`{"keys": "roxi"}`))
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(http.StatusBadRequest, rr.Code)
+
+		req, _ = http.NewRequest("GET", "/_mget", nil)
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(http.StatusMethodNotAllowed, rr.Code)
+	})
+}
+
+func TestMSet(t *testing.T) {
+	redisBackends(t, func(t *testing.T, config Config) {
+		assert := assert.New(t)
+
+		proxy, redisClient := newRedisProxy(t, config)
+
+		var ctx = context.Background()
+		redisClient.Del(ctx, "roxi", "tita", "heff")
+
+		handler := http.HandlerFunc(proxy.MSetHandler)
+
+		for _, path := range []string{"/_mset?ttl=5s", "/_mset?ttl=5s&atomic=1"} {
+			req, _ := http.NewRequest("POST", path, strings.NewReader(`{"roxi": "rocks", "tita": "is cool", "heff": "zao"}`))
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			assert.Equal(http.StatusOK, rr.Code)
+			assert.Equal(`{"status":{"heff":"ok","roxi":"ok","tita":"ok"}}`, rr.Body.String())
+
+			values, err := redisClient.MGet(ctx, "roxi", "tita", "heff").Result()
+			assert.NoError(err)
+			assert.Equal([]interface{}{"rocks", "is cool", "zao"}, values)
+			ttl, err := redisClient.PTTL(ctx, "tita").Result()
+			assert.NoError(err)
+			assert.InDelta(5*time.Second, ttl, float64(100*time.Millisecond))
+
+			roxi, ok := proxy.Peek("roxi")
+			assert.True(ok)
+			assert.Equal("rocks", roxi.Value)
+			redisClient.Del(ctx, "roxi", "tita", "heff")
+		}
+
+		req, _ := http.NewRequest("POST", "/_mset", strings.NewReader(`["roxi"]`))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(http.StatusBadRequest, rr.Code)
+
+		req, _ = http.NewRequest("POST", "/_mset?atomic=maybe", strings.NewReader(`{}`))
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(http.StatusBadRequest, rr.Code)
+	})
+}
+
+// flakyCache is an external cache that fails to store some keys
+type flakyCache struct {
+	slowCache
+	fail map[string]bool
+}
+
+func (f *flakyCache) MSet(ctx context.Context, keys []string, values []string, ttl time.Duration, atomic bool) []error {
+	errs := make([]error, len(keys))
+	for i, key := range keys {
+		if f.fail[key] {
+			errs[i] = errors.New("OOM command not allowed")
+		}
+	}
+	return errs
+}
+
+func TestMSetPartialFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	proxy := newLocalCache(Config{})
+	defer proxy.Close()
+	proxy.cache = &flakyCache{fail: map[string]bool{"tita": true}}
+
+	handler := http.HandlerFunc(proxy.MSetHandler)
+	req, _ := http.NewRequest("POST", "/_mset", strings.NewReader(`{"roxi": "rocks", "tita": "is cool"}`))
+	rr := httptest.NewRecorder()
 	handler.ServeHTTP(rr, req)
-	assert.Equal(rr.Code, http.StatusOK)
-	assert.Equal(rr.Body.String(), `{"tito": "pow"}`)
+	assert.Equal(http.StatusMultiStatus, rr.Code)
+	assert.Equal(`{"status":{"roxi":"ok","tita":"failed put"}}`, rr.Body.String())
 
-	// we should still have this data
-	req, _ = http.NewRequest("GET", "/heff", nil)
+	// a key the external cache did not store is not cached locally either
+	_, ok := proxy.Peek("roxi")
+	assert.True(ok)
+	_, ok = proxy.Peek("tita")
+	assert.False(ok)
+}
+
+func TestBatchLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	proxy := NewProxyCacheWithCache(Config{KeyPathPrefix: "/cache"}, NewMemoryCache(nil))
+	defer proxy.Close()
+	mget := http.HandlerFunc(proxy.MGetHandler)
+	mset := http.HandlerFunc(proxy.MSetHandler)
+
+	// empty batches still get their field
+	req, _ := http.NewRequest("POST", "/_mget", strings.NewReader(`[]`))
+	rr := httptest.NewRecorder()
+	mget.ServeHTTP(rr, req)
+	assert.Equal(`{"values":{}}`, rr.Body.String())
+	req, _ = http.NewRequest("POST", "/_mset", strings.NewReader(`{}`))
 	rr = httptest.NewRecorder()
-	handler.ServeHTTP(rr, req)
-	assert.Equal(rr.Code, http.StatusOK)
-	assert.Equal(rr.Body.String(), `{"heff": "zao"}`)
+	mset.ServeHTTP(rr, req)
+	assert.Equal(`{"status":{}}`, rr.Body.String())
 
-	// and the third data should be empty
-	// delete from redis backing to make results clear
-	redisClient.Del(ctx, "rocco")
+	keys := make([]string, maxBatchKeys+1)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+	body, _ := json.Marshal(keys)
+	req, _ = http.NewRequest("POST", "/_mget", bytes.NewReader(body))
 	rr = httptest.NewRecorder()
-	req, _ = http.NewRequest("GET", "/rocco", nil)
-	handler.ServeHTTP(rr, req)
-	assert.Equal(rr.Code, http.StatusNotFound)
-	_, ok := proxy.Data["rocco"]
+	mget.ServeHTTP(rr, req)
+	assert.Equal(http.StatusRequestEntityTooLarge, rr.Code)
+	assert.Equal(`{"error":"too many keys, at most 1000"}`, rr.Body.String())
+
+	req, _ = http.NewRequest("POST", "/_mset", strings.NewReader(`{"roxi": "`+strings.Repeat("x", maxBatchBody)+`"}`))
+	rr = httptest.NewRecorder()
+	mset.ServeHTTP(rr, req)
+	assert.Equal(http.StatusRequestEntityTooLarge, rr.Code)
+
+	// the route names are not keys, even under a prefix
+	for _, key := range []string{"_mget", "_mset"} {
+		req, _ = http.NewRequest("GET", "/cache/"+key, nil)
+		rr = httptest.NewRecorder()
+		http.HandlerFunc(proxy.PayloadHandler).ServeHTTP(rr, req)
+		assert.Equal(http.StatusBadRequest, rr.Code)
+	}
+}
+
+func TestBatchKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	proxy := NewProxyCacheWithCache(Config{}, NewMemoryCache(nil))
+	defer proxy.Close()
+
+	req, _ := http.NewRequest("PUT", "/img", strings.NewReader("png"))
+	req.Header.Set("Content-Type", "image/png")
+	rr := httptest.NewRecorder()
+	proxy.ServeHTTP(rr, req)
+	assert.Equal(http.StatusOK, rr.Code)
+	req, _ = http.NewRequest("PUT", "/roxi%20rocks", strings.NewReader("yes"))
+	rr = httptest.NewRecorder()
+	proxy.ServeHTTP(rr, req)
+	assert.Equal(http.StatusOK, rr.Code)
+
+	// keys are read like the path of a GET
+	req, _ = http.NewRequest("POST", "/_mget", strings.NewReader(`["roxi rocks", "./img", "{user:42}:name"]`))
+	rr = httptest.NewRecorder()
+	proxy.ServeHTTP(rr, req)
+	assert.Equal(`{"values":{"img":"png","roxi rocks":"yes","{user:42}:name":null}}`, rr.Body.String())
+
+	// and the ones GET rejects fail the batch, the content type of a key
+	// is not one of them
+	for _, keys := range []string{`["img:content-type"]`, `["img", ""]`, `["_mget"]`, `["100%"]`, `[".."]`} {
+		req, _ = http.NewRequest("POST", "/_mget", strings.NewReader(keys))
+		rr = httptest.NewRecorder()
+		proxy.ServeHTTP(rr, req)
+		assert.Equal(http.StatusBadRequest, rr.Code, keys)
+		assert.Equal(`{"error":"bad key"}`, rr.Body.String(), keys)
+	}
+
+	// the same goes for /_mset, which stores nothing when a key is bad
+	req, _ = http.NewRequest("POST", "/_mset", strings.NewReader(`{"roxi rocks": "always", "{user:42}:name": "roxi"}`))
+	rr = httptest.NewRecorder()
+	proxy.ServeHTTP(rr, req)
+	assert.Equal(`{"status":{"roxi rocks":"ok","{user:42}:name":"ok"}}`, rr.Body.String())
+	for _, p := range []string{"/roxi%20rocks", "/%7Buser:42%7D:name"} {
+		req, _ = http.NewRequest("GET", p, nil)
+		rr = httptest.NewRecorder()
+		proxy.ServeHTTP(rr, req)
+		assert.Equal(http.StatusOK, rr.Code, p)
+	}
+	for _, items := range []string{`{"tita": "x", "img:content-type": "00000000 text/html"}`, `{"tita": "x", "": "y"}`, `{"_mget": "x"}`, `{"tita": "x", "./tita": "y"}`} {
+		req, _ = http.NewRequest("POST", "/_mset", strings.NewReader(items))
+		rr = httptest.NewRecorder()
+		proxy.ServeHTTP(rr, req)
+		assert.Equal(http.StatusBadRequest, rr.Code, items)
+		assert.Equal(`{"error":"bad key"}`, rr.Body.String(), items)
+	}
+	_, ok := proxy.Peek("tita")
+	assert.False(ok)
+	stored, err := proxy.cache.Get(context.Background(), contentTypeKey("img"))
+	assert.NoError(err)
+	assert.Equal("image/png", decodeContentType("png", *stored))
+}
+
+func TestRoutes(t *testing.T) {
+	assert := assert.New(t)
+
+	// served the way main serves it
+	proxy := NewProxyCacheWithCache(Config{KeyPathPrefix: "/cache"}, NewMemoryCache(nil))
+	defer proxy.Close()
+
+	req, _ := http.NewRequest("PUT", "/cache/users/42/profile", strings.NewReader("roxi"))
+	rr := httptest.NewRecorder()
+	proxy.ServeHTTP(rr, req)
+	assert.Equal(http.StatusOK, rr.Code)
+
+	// paths that are not clean are served, not redirected
+	req, _ = http.NewRequest("GET", "/cache/users//42/./profile/", nil)
+	rr = httptest.NewRecorder()
+	proxy.ServeHTTP(rr, req)
+	assert.Equal(http.StatusOK, rr.Code)
+	assert.Equal(`{"key":"users/42/profile","value":"roxi"}`, rr.Body.String())
+
+	// the batch routes are under the prefix too
+	req, _ = http.NewRequest("POST", "/cache/_mset", strings.NewReader(`{"tita": "is cool"}`))
+	rr = httptest.NewRecorder()
+	proxy.ServeHTTP(rr, req)
+	assert.Equal(`{"status":{"tita":"ok"}}`, rr.Body.String())
+	req, _ = http.NewRequest("POST", "/cache/_mget", strings.NewReader(`["tita", "users/42/profile"]`))
+	rr = httptest.NewRecorder()
+	proxy.ServeHTTP(rr, req)
+	assert.Equal(`{"values":{"tita":"is cool","users/42/profile":"roxi"}}`, rr.Body.String())
+
+	req, _ = http.NewRequest("POST", "/_mget", strings.NewReader(`["tita"]`))
+	rr = httptest.NewRecorder()
+	proxy.ServeHTTP(rr, req)
+	assert.Equal(http.StatusBadRequest, rr.Code)
+}
+
+func TestPutCancelled(t *testing.T) {
+	assert := assert.New(t)
+
+	proxy := NewProxyCacheWithCache(Config{}, NewMemoryCache(nil))
+	defer proxy.Close()
+
+	// a put that never reached the external cache is not served locally
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := proxy.HandlePut(cancelled, "roxi", "rocks", 0)
+	assert.Equal(context.Canceled, err)
+	_, ok := proxy.Peek("roxi")
+	assert.False(ok)
+}
+
+func TestHierarchicalKeys(t *testing.T) {
+	redisBackends(t, func(t *testing.T, config Config) {
+		assert := assert.New(t)
+
+		proxy, redisClient := newRedisProxy(t, config)
+
+		var ctx = context.Background()
+		redisClient.Del(ctx, "users/42/profile", "users/43/profile", "profile", "acme/users/42")
+
+		handler := http.HandlerFunc(proxy.PayloadHandler)
+
+		req, _ := http.NewRequest("PUT", "/users/42/profile?ttl=1m", strings.NewReader("roxi"))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(http.StatusOK, rr.Code)
+		assert.Equal(`{"key":"users/42/profile","value":"roxi"}`, rr.Body.String())
+
+		value, err := redisClient.Get(ctx, "users/42/profile").Result()
+		assert.NoError(err)
+		assert.Equal("roxi", value)
+
+		// other users have their own profile
+		req, _ = http.NewRequest("GET", "/users/43/profile", nil)
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(http.StatusNotFound, rr.Code)
+
+		// paths that mean the same thing are the same key
+		for _, p := range []string{"/users//42/./profile/", "/users/41/../42/profile", "/users/42/profile?cache=bust"} {
+			req, _ = http.NewRequest("GET", p, nil)
+			rr = httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			assert.Equal(http.StatusOK, rr.Code, p)
+		}
+
+		// keys are unescaped, except for an escaped slash and the % escaping it
+		for p, key := range map[string]string{
+			"/users%2F42%2Fprofile": "users%2F42%2Fprofile",
+			"/roxi rocks":           "roxi rocks",
+			"/roxi%20rock%73":       "roxi rocks",
+			"/100%25":               "100%25",
+			"/%7Buser:42%7D:name":   "{user:42}:name",
+		} {
+			req, _ = http.NewRequest("PUT", p, strings.NewReader("yes"))
+			rr = httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			assert.Equal(`{"key":"`+key+`","value":"yes"}`, rr.Body.String(), p)
+		}
+		redisClient.Del(ctx, "users%2F42%2Fprofile", "roxi rocks", "100%25", "{user:42}:name")
+
+		// so hash tags put keys in the same redis cluster slot
+		var slots []int
+		for _, p := range []string{"/{user:42}:name", "/{user:42}:email"} {
+			req, _ = http.NewRequest("GET", p, nil)
+			key, ok := proxy.requestKey(req)
+			assert.True(ok)
+			slots = append(slots, resp.KeySlot(key))
+		}
+		assert.Equal(slots[0], slots[1])
+		assert.Equal(resp.KeySlot("user:42"), slots[0])
+
+		for _, p := range []string{"/", "/.."} {
+			req, _ = http.NewRequest("GET", p, nil)
+			rr = httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			assert.Equal(http.StatusBadRequest, rr.Code, p)
+		}
+
+		// with a prefix only the rest of the path is the key
+		proxy.KeyPathPrefix = "/cache/"
+		req, _ = http.NewRequest("PUT", "/cache/acme/users/42", strings.NewReader("tita"))
+		rr = httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		assert.Equal(http.StatusOK, rr.Code)
+		value, err = redisClient.Get(ctx, "acme/users/42").Result()
+		assert.NoError(err)
+		assert.Equal("tita", value)
+
+		for _, p := range []string{"/users/42/profile", "/cache", "/cachette/x"} {
+			req, _ = http.NewRequest("GET", p, nil)
+			rr = httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			assert.Equal(http.StatusBadRequest, rr.Code, p)
+		}
+	})
+}
+
+func TestRedisClient(t *testing.T) {
+	assert := assert.New(t)
+
+	s := resptest.NewServer()
+	defer s.Close()
+	rc, err := NewRedisClient(nil, s.Addr())
+	assert.NoError(err)
+	defer rc.Client.Close()
+
+	var ctx = context.Background()
+	rc.Delete(ctx, "tita")
+
+	ok, err := rc.Exists(ctx, "tita")
+	assert.NoError(err)
+	assert.False(ok)
+	_, ok, err = rc.TTL(ctx, "tita")
+	assert.NoError(err)
 	assert.False(ok)
 
-	_, ok2 := proxy.Data["tito"]
-	assert.True(ok2)
-	_, ok3 := proxy.Data["heff"]
-	assert.True(ok3)
+	err = rc.Put(ctx, "tita", "is fire", 5*time.Second)
+	assert.NoError(err)
+	ok, err = rc.Exists(ctx, "tita")
+	assert.NoError(err)
+	assert.True(ok)
+	ttl, ok, err := rc.TTL(ctx, "tita")
+	assert.NoError(err)
+	assert.True(ok)
+	assert.InDelta(5*time.Second, ttl, float64(100*time.Millisecond))
+
+	deleted, err := rc.Delete(ctx, "tita")
+	assert.NoError(err)
+	assert.True(deleted)
+	deleted, err = rc.Delete(ctx, "tita")
+	assert.NoError(err)
+	assert.False(deleted)
+	err = rc.Put(ctx, "tita", "is fire", 0)
+	assert.NoError(err)
+	deletes, err := rc.MDelete(ctx, []string{"tita", contentTypeKey("tita")})
+	assert.NoError(err)
+	assert.Equal([]bool{true, false}, deletes)
+
+	// a request that is gone never reaches redis
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = rc.Get(cancelled, "tita")
+	assert.Equal(context.Canceled, err)
+	err = rc.Put(cancelled, "tita", "is fire", 0)
+	assert.Equal(context.Canceled, err)
+	ok, err = rc.Exists(ctx, "tita")
+	assert.NoError(err)
+	assert.False(ok)
+}
+
+func TestRedisClusterClient(t *testing.T) {
+	assert := assert.New(t)
+
+	cluster := resptest.NewCluster(3)
+	defer cluster.Close()
+	rc, err := NewRedisClusterClient(nil, cluster.Addrs()[:1])
+	assert.NoError(err)
+	defer rc.Client.Close()
+
+	// the keys are in different slots, owned by different nodes
+	var ctx = context.Background()
+	keys := []string{"roxi", "tita", "pip", "merry", "{user:42}:name", "{user:42}:email"}
+	values := []string{"rocks", "is fire", "squeak", "brandybuck", "heff", "heff@example.com"}
+	errs := rc.MSet(ctx, keys, values, time.Minute, false)
+	for _, err := range errs {
+		assert.NoError(err)
+	}
+	items, err := rc.MGet(ctx, append([]string{"nobody"}, keys...))
+	assert.NoError(err)
+	assert.Nil(items[0])
+	for i, value := range values {
+		assert.Equal(value, items[i+1].Value)
+		assert.InDelta(time.Minute, items[i+1].TTL, float64(time.Second))
+	}
+
+	// atomic writes need a single slot, which hash tags give
+	errs = rc.MSet(ctx, []string{"roxi", "tita"}, []string{"a", "b"}, 0, true)
+	assert.Equal([]error{errCrossSlot, errCrossSlot}, errs)
+	errs = rc.MSet(ctx, []string{"{user:42}:name", "{user:42}:email"}, []string{"tita", "tita@example.com"}, 0, true)
+	assert.Equal([]error{nil, nil}, errs)
+	value, err := rc.Get(ctx, "{user:42}:email")
+	assert.NoError(err)
+	assert.Equal("tita@example.com", *value)
 
-	//Requirement: Fixed key size
-	assert.Equal(len(proxy.Data), 2)
+	// the client follows a slot that moved to another node
+	slot := resp.KeySlot("roxi")
+	cluster.MoveSlot(slot, (slot*3/resp.Slots+1)%3)
+	value, err = rc.Get(ctx, "roxi")
+	assert.NoError(err)
+	assert.Equal("rocks", *value)
+	items, err = rc.MGet(ctx, []string{"roxi", "tita"})
+	assert.NoError(err)
+	assert.Equal("rocks", items[0].Value)
+	assert.Equal("is fire", items[1].Value)
+}
+
+func TestProxyWithRedisCluster(t *testing.T) {
+	assert := assert.New(t)
+
+	cluster := resptest.NewCluster(3)
+	defer cluster.Close()
+	config := Config{
+		RedisClusterNodes:   cluster.Addrs(),
+		InvalidationChannel: "invalidations",
+	}
+	proxy := NewProxyCache(config)
+	defer proxy.Close()
+	proxy2 := NewProxyCache(config)
+	defer proxy2.Close()
+
+	req, _ := http.NewRequest("POST", "/_mset", strings.NewReader(`{"roxi": "rocks", "tita": "is cool", "heff": "zao"}`))
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(proxy.MSetHandler).ServeHTTP(rr, req)
+	assert.Equal(`{"status":{"heff":"ok","roxi":"ok","tita":"ok"}}`, rr.Body.String())
+
+	req, _ = http.NewRequest("POST", "/_mget", strings.NewReader(`["roxi", "tita", "heff", "nobody"]`))
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(proxy2.MGetHandler).ServeHTTP(rr, req)
+	assert.Equal(`{"values":{"heff":"zao","nobody":null,"roxi":"rocks","tita":"is cool"}}`, rr.Body.String())
+
+	// invalidations are published to every node, so proxy2 drops its copy
+	req, _ = http.NewRequest("PUT", "/roxi", strings.NewReader("rolls"))
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(proxy.PayloadHandler).ServeHTTP(rr, req)
+	assert.Equal(http.StatusOK, rr.Code)
+	assert.Eventually(func() bool {
+		_, ok := proxy2.Peek("roxi")
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+
+	// the keys of an atomic mset have to share a slot
+	req, _ = http.NewRequest("POST", "/_mset?atomic=1", strings.NewReader(`{"roxi": "rocks", "tita": "is cool"}`))
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(proxy.MSetHandler).ServeHTTP(rr, req)
+	assert.Equal(http.StatusBadRequest, rr.Code)
+	assert.Equal(`{"error":"redis cluster: keys of an atomic write must be in the same hash slot, use a hash tag like {user:42}"}`, rr.Body.String())
+
+	// so do the keys of MSET, like with the cluster itself
+	client := startRESPServer(t, proxy)
+	err := client.MSet(context.Background(), "roxi", "rocks", "tita", "is cool").Err()
+	assert.EqualError(err, "CROSSSLOT Keys in request don't hash to the same slot")
+	err = client.MSet(context.Background(), "{user:42}:name", "tita", "{user:42}:email", "tita@example.com").Err()
+	assert.NoError(err)
+
+	// a content type is stored next to its value, in the same slot only
+	// when the key has a hash tag
+	ctx := context.Background()
+	avatar := ValueStore{Value: "png", ContentType: "image/png"}
+	errs := proxy.HandleMSet(ctx, []string{"{user:42}:avatar"}, []ValueStore{avatar}, 0, true)
+	assert.Equal([]error{nil}, errs)
+	value, err := proxy2.HandleGetValue(ctx, "{user:42}:avatar")
+	assert.NoError(err)
+	assert.Equal("image/png", value.ContentType)
+	errs = proxy.HandleMSet(ctx, []string{"avatar"}, []ValueStore{avatar}, 0, true)
+	assert.Equal([]error{errCrossSlot}, errs)
+	assert.NoError(proxy.HandlePutValue(ctx, "avatar", avatar, 0))
 }
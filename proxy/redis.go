@@ -2,20 +2,32 @@ package proxy
 
 import (
 	"context"
-	"log"
+	"errors"
 	"time"
 
+	"github.com/cat-turner/proxy/resp"
 	redis "github.com/go-redis/redis/v8"
 )
 
+// errCrossSlot is returned for atomic writes to keys in more than one hash
+// slot of a Redis Cluster, which can not share a transaction
+var errCrossSlot = errors.New("redis cluster: keys of an atomic write must be in the same hash slot, use a hash tag like {user:42}")
+
 // RedisClient is used in this package for the external cache
 type RedisClient struct {
-	Client     redis.Client
+	Client     redis.UniversalClient
 	KeyTimeout time.Duration
+
+	// cluster is set when Client talks to a Redis Cluster
+	cluster bool
+
+	// tracker, when set, has redis tell us which keys changed
+	tracker *tracker
 }
 
-// NewRedisClient creates new redis client
-func NewRedisClient(keyTimeout *time.Duration, redisUrl string) RedisClient {
+// NewRedisClient creates new redis client, it fails when redis can not be
+// reached
+func NewRedisClient(keyTimeout *time.Duration, redisUrl string) (RedisClient, error) {
 	var ctx = context.Background()
 	client := redis.NewClient(&redis.Options{
 		Addr:     redisUrl,
@@ -24,24 +36,115 @@ func NewRedisClient(keyTimeout *time.Duration, redisUrl string) RedisClient {
 	})
 	_, err := client.Ping(ctx).Result()
 	if err != nil {
-		log.Fatal(err)
+		client.Close()
+		return RedisClient{}, err
 	}
 	if keyTimeout != nil {
 		return RedisClient{
-			Client:     *client,
+			Client:     client,
 			KeyTimeout: *keyTimeout,
-		}
+		}, nil
 	}
 
 	return RedisClient{
-		Client: *client,
-	}
+		Client: client,
+	}, nil
 }
 
-// Put ...
-func (rc RedisClient) Put(key string, value string) error {
+// NewRedisClusterClient creates a redis client for a Redis Cluster. nodes are
+// the addresses of some of its nodes, the client finds the rest. Commands go
+// to the node owning their key's hash slot and follow MOVED and ASK redirects
+// when slots move.
+func NewRedisClusterClient(keyTimeout *time.Duration, nodes []string) (RedisClient, error) {
 	var ctx = context.Background()
-	err := rc.Client.Set(ctx, key, value, rc.KeyTimeout).Err()
+	client := redis.NewClusterClient(&redis.ClusterOptions{
+		Addrs: nodes,
+	})
+	_, err := client.Ping(ctx).Result()
+	if err != nil {
+		client.Close()
+		return RedisClient{}, err
+	}
+	rc := RedisClient{
+		Client:  client,
+		cluster: true,
+	}
+	if keyTimeout != nil {
+		rc.KeyTimeout = *keyTimeout
+	}
+	return rc, nil
+}
+
+// NewTrackingRedisClient creates a redis client that uses client side caching:
+// redis remembers the keys the client may have cached and tells it when they
+// change (CLIENT TRACKING). invalidate is called with the keys that changed,
+// nil means every key. It needs redis 6 or later.
+func NewTrackingRedisClient(keyTimeout *time.Duration, redisUrl string, opts TrackingOptions, invalidate func(keys []string)) (RedisClient, error) {
+	rc, err := NewRedisClient(keyTimeout, redisUrl)
+	if err != nil {
+		return rc, err
+	}
+	t, err := startTracker(redisUrl, opts, invalidate)
+	if err != nil {
+		rc.Client.Close()
+		return RedisClient{}, err
+	}
+	rc.tracker = t
+	return rc, nil
+}
+
+// StopTracking stops client side caching, redis no longer sends invalidations
+func (rc RedisClient) StopTracking() error {
+	if rc.tracker == nil {
+		return nil
+	}
+	return rc.tracker.Close()
+}
+
+// keys returns the client for commands on keys. In the default tracking mode
+// redis only reports changes to keys that were read on a tracked connection,
+// and with NOLOOP not the changes a connection makes itself, so the proxy's
+// own writes go through the same connections.
+func (rc RedisClient) keys() redis.UniversalClient {
+	if rc.tracker != nil {
+		if c := rc.tracker.client(); c != nil {
+			return c
+		}
+	}
+	return rc.Client
+}
+
+// slotGroups splits the indexes of keys into groups that can go in a single
+// multi-key command, one per hash slot in a cluster and all of them otherwise
+func (rc RedisClient) slotGroups(keys []string) [][]int {
+	if !rc.cluster {
+		group := make([]int, len(keys))
+		for i := range keys {
+			group[i] = i
+		}
+		return [][]int{group}
+	}
+	var groups [][]int
+	slots := make(map[int]int)
+	for i, key := range keys {
+		slot := resp.KeySlot(key)
+		g, ok := slots[slot]
+		if !ok {
+			g = len(groups)
+			slots[slot] = g
+			groups = append(groups, nil)
+		}
+		groups[g] = append(groups[g], i)
+	}
+	return groups
+}
+
+// Put stores the value for ttl, or KeyTimeout when ttl is zero
+func (rc RedisClient) Put(ctx context.Context, key string, value string, ttl time.Duration) error {
+	if ttl == 0 {
+		ttl = rc.KeyTimeout
+	}
+	err := rc.keys().Set(ctx, key, value, ttl).Err()
 	if err != nil {
 		return err
 	}
@@ -49,9 +152,8 @@ func (rc RedisClient) Put(key string, value string) error {
 }
 
 // Get ...
-func (rc RedisClient) Get(key string) (*string, error) {
-	var ctx = context.Background()
-	val, err := rc.Client.Get(ctx, key).Result()
+func (rc RedisClient) Get(ctx context.Context, key string) (*string, error) {
+	val, err := rc.keys().Get(ctx, key).Result()
 	if err == redis.Nil {
 		return nil, nil
 	} else if err != nil {
@@ -60,3 +162,184 @@ func (rc RedisClient) Get(key string) (*string, error) {
 	return &val, nil
 
 }
+
+// Delete removes the key, it reports false if redis did not have it
+func (rc RedisClient) Delete(ctx context.Context, key string) (bool, error) {
+	n, err := rc.keys().Del(ctx, key).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// MDelete removes many keys in one pipeline, a DEL for each so that in a
+// cluster they can be in different slots. It reports whether redis had each.
+func (rc RedisClient) MDelete(ctx context.Context, keys []string) ([]bool, error) {
+	pipe := rc.keys().Pipeline()
+	dels := make([]*redis.IntCmd, len(keys))
+	for i, key := range keys {
+		dels[i] = pipe.Del(ctx, key)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	deleted := make([]bool, len(keys))
+	for i, del := range dels {
+		deleted[i] = del.Val() > 0
+	}
+	return deleted, nil
+}
+
+// Publish sends message to everyone subscribed to channel
+func (rc RedisClient) Publish(ctx context.Context, channel string, message string) error {
+	return rc.Client.Publish(ctx, channel, message).Err()
+}
+
+// Subscribe calls handle with every message on channel from its own go
+// routine, until the returned function is called. go-redis reconnects the
+// subscription if the connection drops.
+func (rc RedisClient) Subscribe(channel string, handle func(message string)) (func() error, error) {
+	var ctx = context.Background()
+	pubsub := rc.Client.Subscribe(ctx, channel)
+	// wait for redis to confirm, so no message sent after we return is missed
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+	go func() {
+		for msg := range pubsub.Channel() {
+			handle(msg.Payload)
+		}
+	}()
+	return pubsub.Close, nil
+}
+
+// PSubscribe calls handle with every message on a channel matching pattern,
+// like Subscribe
+func (rc RedisClient) PSubscribe(pattern string, handle func(channel string, message string)) (func() error, error) {
+	var ctx = context.Background()
+	pubsub := rc.Client.PSubscribe(ctx, pattern)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+	go func() {
+		for msg := range pubsub.Channel() {
+			handle(msg.Channel, msg.Payload)
+		}
+	}()
+	return pubsub.Close, nil
+}
+
+// MSet stores many values in one round trip, in a MULTI/EXEC transaction when
+// atomic is set so that nobody sees some of them without the others. In a
+// cluster the pipeline is split between the nodes, and atomic writes need
+// every key in the same hash slot.
+func (rc RedisClient) MSet(ctx context.Context, keys []string, values []string, ttl time.Duration, atomic bool) []error {
+	if ttl == 0 {
+		ttl = rc.KeyTimeout
+	}
+	errs := make([]error, len(keys))
+	if atomic && len(rc.slotGroups(keys)) > 1 {
+		for i := range errs {
+			errs[i] = errCrossSlot
+		}
+		return errs
+	}
+	var pipe redis.Pipeliner
+	if atomic {
+		pipe = rc.keys().TxPipeline()
+	} else {
+		pipe = rc.keys().Pipeline()
+	}
+	cmds := make([]*redis.StatusCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.Set(ctx, key, values[i], ttl)
+	}
+	// a failed transaction or connection sets the error of every command
+	pipe.Exec(ctx)
+
+	for i, cmd := range cmds {
+		errs[i] = cmd.Err()
+	}
+	return errs
+}
+
+// MGet gets the values of keys with one MGET, and the time each has left, in
+// one round trip. In a cluster there is an MGET for each hash slot, as a
+// command's keys must share one.
+func (rc RedisClient) MGet(ctx context.Context, keys []string) ([]*Item, error) {
+	items := make([]*Item, len(keys))
+	if len(keys) == 0 {
+		return items, nil
+	}
+	groups := rc.slotGroups(keys)
+	pipe := rc.keys().Pipeline()
+	mgets := make([]*redis.SliceCmd, len(groups))
+	for g, group := range groups {
+		groupKeys := make([]string, len(group))
+		for j, i := range group {
+			groupKeys[j] = keys[i]
+		}
+		mgets[g] = pipe.MGet(ctx, groupKeys...)
+	}
+	pttls := make([]*redis.DurationCmd, len(keys))
+	for i, key := range keys {
+		pttls[i] = pipe.PTTL(ctx, key)
+	}
+	_, err := pipe.Exec(ctx)
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	for g, group := range groups {
+		values, err := mgets[g].Result()
+		if err != nil {
+			return nil, err
+		}
+		for j, v := range values {
+			value, ok := v.(string)
+			if !ok {
+				// redis does not have the key
+				continue
+			}
+			i := group[j]
+			ttl := pttls[i].Val()
+			switch {
+			case ttl == -2:
+				// the key expired between the commands
+				continue
+			case ttl < 0:
+				// the key does not expire
+				ttl = 0
+			}
+			items[i] = &Item{Value: value, TTL: ttl}
+		}
+	}
+	return items, nil
+}
+
+// Exists reports whether redis has the key
+func (rc RedisClient) Exists(ctx context.Context, key string) (bool, error) {
+	n, err := rc.keys().Exists(ctx, key).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// TTL returns the time the key has left in redis
+func (rc RedisClient) TTL(ctx context.Context, key string) (time.Duration, bool, error) {
+	ttl, err := rc.keys().PTTL(ctx, key).Result()
+	if err != nil {
+		return 0, false, err
+	}
+	switch {
+	case ttl == -2:
+		return 0, false, nil
+	case ttl < 0:
+		// the key does not expire
+		return 0, true, nil
+	}
+	return ttl, true, nil
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// response is the JSON body PayloadHandler replies with. Successful requests
+// get the key and, for GET and PUT, its value. Failed requests only get error.
+type response struct {
+	Key string `json:"key,omitempty"`
+	// Value is a pointer so an empty value is still sent
+	Value *string `json:"value,omitempty"`
+	// Encoding is base64 when Value is, see jsonValue
+	Encoding    string `json:"encoding,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Deleted     bool   `json:"deleted,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// valuesResponse is the JSON body MGetHandler replies with, the values of the
+// keys and null for missing keys
+type valuesResponse struct {
+	Values map[string]*string `json:"values"`
+	// Encodings has the keys whose value is base64, see jsonValue
+	Encodings map[string]string `json:"encodings,omitempty"`
+}
+
+// statusResponse is the JSON body MSetHandler replies with, whether each key
+// was stored
+type statusResponse struct {
+	Status map[string]string `json:"status"`
+}
+
+// valueResponse is the response for key and its value
+func valueResponse(key string, value ValueStore) response {
+	v, encoding := jsonValue(value.Value)
+	return response{Key: key, Value: &v, Encoding: encoding, ContentType: value.ContentType}
+}
+
+// jsonValue returns value as it is sent in JSON, which can only hold UTF-8.
+// Other values, like images, are sent as base64 with the encoding "base64".
+func jsonValue(value string) (string, string) {
+	if utf8.ValidString(value) {
+		return value, ""
+	}
+	return base64.StdEncoding.EncodeToString([]byte(value)), "base64"
+}
+
+// writeResponse replies with status and body encoded as JSON
+func writeResponse(w http.ResponseWriter, status int, body interface{}) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		// a struct of strings always encodes
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+// writeRaw replies with the value itself as the body, with the content type
+// it was stored with
+func writeRaw(w http.ResponseWriter, value ValueStore) {
+	contentType := value.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, value.Value)
+}
+
+// wantsRaw reports whether the client asked for the value itself rather than
+// JSON, either with ?raw=1 or with an Accept header that takes the content
+// type of the value
+func wantsRaw(r *http.Request, contentType string) bool {
+	if raw, err := strconv.ParseBool(r.URL.Query().Get("raw")); err == nil {
+		return raw
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == "application/json" {
+		// JSON values are sent in the JSON envelope like any other
+		return false
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		accepted, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		if accepted == mediaType {
+			return true
+		}
+		// like image/*, but not */* which any browser sends
+		if accepted != "*/*" && strings.HasSuffix(accepted, "/*") &&
+			strings.HasPrefix(mediaType, strings.TrimSuffix(accepted, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeError replies with status and an error message
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeResponse(w, status, response{Error: msg})
+}
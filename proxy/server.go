@@ -0,0 +1,436 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cat-turner/proxy/resp"
+)
+
+// serverVersion is reported to clients by HELLO and INFO
+const serverVersion = "1.0.0"
+
+// errSyntax is the reply to commands with options we do not understand
+var errSyntax = errors.New("ERR syntax error")
+
+// defaultPipelineLimit is the number of commands a client can have in flight
+// when RESP_PIPELINE_LIMIT is not set
+const defaultPipelineLimit = 128
+
+// readOnlyCommands do not change the cache, so they can run alongside each
+// other when a client pipelines them
+var readOnlyCommands = map[string]bool{
+	"PING":    true,
+	"COMMAND": true,
+	"INFO":    true,
+	"GET":     true,
+	"MGET":    true,
+}
+
+// writerPool recycles the writers used to build replies
+var writerPool = sync.Pool{
+	New: func() interface{} { return resp.NewWriter(nil) },
+}
+
+// RESPServer serves the proxy cache over the Redis serialization protocol,
+// so any Redis client can use the proxy as a read-through cache
+type RESPServer struct {
+	cache *ProxyCache
+
+	// pipelineLimit is the maximum number of commands from one client
+	// that are read but not yet answered
+	pipelineLimit int
+
+	lastClientID     int64
+	connectedClients int64
+}
+
+// respClient is the state the server keeps for each connection
+type respClient struct {
+	id int64
+	// proto is the protocol version negotiated with HELLO
+	proto int
+}
+
+// NewRESPServer creates a RESPServer in front of the given proxy cache.
+// pipelineLimit caps the commands a client can have in flight, zero uses the
+// default.
+func NewRESPServer(pc *ProxyCache, pipelineLimit int) *RESPServer {
+	if pipelineLimit <= 0 {
+		pipelineLimit = defaultPipelineLimit
+	}
+	return &RESPServer{cache: pc, pipelineLimit: pipelineLimit}
+}
+
+// ListenAndServe listens on the TCP address addr and serves clients
+func (s *RESPServer) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Print(fmt.Sprintf("RESP listening on %v", l.Addr()))
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l and serves each of them in its own go routine
+func (s *RESPServer) Serve(l net.Listener) error {
+	defer l.Close()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.serveConn(context.Background(), conn)
+	}
+}
+
+// serveConn reads commands from a single client until it disconnects.
+//
+// Clients may pipeline commands, so commands keep being read while earlier
+// ones run. Read-only commands run concurrently and anything else waits for
+// the commands before it to finish, which keeps the results the same as if
+// the commands ran one at a time. Replies are written back in the order the
+// commands were received. Commands run with ctx.
+func (s *RESPServer) serveConn(ctx context.Context, conn net.Conn) {
+	client := &respClient{
+		id:    atomic.AddInt64(&s.lastClientID, 1),
+		proto: resp.RESP2,
+	}
+	atomic.AddInt64(&s.connectedClients, 1)
+	defer atomic.AddInt64(&s.connectedClients, -1)
+
+	// like LimitNumClients, the buffered channel caps the number of commands
+	// a client can have in flight before we stop reading from it
+	replies := make(chan *pendingReply, s.pipelineLimit)
+	written := make(chan struct{})
+	go func() {
+		s.writeReplies(conn, replies)
+		close(written)
+	}()
+	defer func() {
+		// let the outstanding replies go out before hanging up
+		close(replies)
+		<-written
+		conn.Close()
+	}()
+
+	var running sync.WaitGroup
+	r := resp.NewReader(conn)
+	for {
+		args, err := r.ReadCommand()
+		if err != nil {
+			if err != io.EOF {
+				log.Print(err)
+				p := newPendingReply()
+				replies <- p
+				s.reply(p, client.proto, func(w *resp.Writer) { w.WriteError("ERR " + err.Error()) })
+			}
+			return
+		}
+
+		p := newPendingReply()
+		replies <- p
+
+		// commands that change the client state, like HELLO, are never
+		// read-only, so the protocol can not change under running commands
+		name := strings.ToUpper(args[0])
+		if readOnlyCommands[name] {
+			running.Add(1)
+			go func() {
+				defer running.Done()
+				s.reply(p, client.proto, func(w *resp.Writer) { s.dispatch(ctx, w, client, args) })
+			}()
+			continue
+		}
+
+		running.Wait()
+		s.reply(p, client.proto, func(w *resp.Writer) { s.dispatch(ctx, w, client, args) })
+		if name == "QUIT" {
+			return
+		}
+	}
+}
+
+// writeReplies writes replies to the client in order, flushing whenever it
+// catches up with the commands that have been read
+func (s *RESPServer) writeReplies(conn net.Conn, replies chan *pendingReply) {
+	w := bufio.NewWriter(conn)
+	for p := range replies {
+		<-p.done
+		w.Write(p.buf.Bytes())
+		if len(replies) == 0 {
+			if err := w.Flush(); err != nil {
+				// unblock the reader, then keep draining so it can
+				// hand back the commands it already started
+				conn.Close()
+			}
+		}
+	}
+	w.Flush()
+}
+
+// pendingReply is the reply to a command that may still be running
+type pendingReply struct {
+	buf  bytes.Buffer
+	done chan struct{}
+}
+
+func newPendingReply() *pendingReply {
+	return &pendingReply{done: make(chan struct{})}
+}
+
+// reply runs f with a writer that fills p and marks p as done
+func (s *RESPServer) reply(p *pendingReply, proto int, f func(w *resp.Writer)) {
+	w := writerPool.Get().(*resp.Writer)
+	w.Reset(&p.buf)
+	w.SetProtocol(proto)
+	f(w)
+	w.Flush()
+	writerPool.Put(w)
+	close(p.done)
+}
+
+// dispatch runs a single command and writes its reply
+func (s *RESPServer) dispatch(ctx context.Context, w *resp.Writer, client *respClient, args []string) {
+	name := strings.ToUpper(args[0])
+	switch name {
+	case "PING":
+		if len(args) > 2 {
+			wrongArgs(w, args[0])
+		} else if len(args) == 2 {
+			w.WriteBulkString(args[1])
+		} else {
+			w.WriteSimpleString("PONG")
+		}
+	case "QUIT":
+		w.WriteSimpleString("OK")
+	case "HELLO":
+		s.hello(w, client, args)
+	case "INFO":
+		s.writeInfo(w)
+	case "COMMAND":
+		// clients like redis-cli ask for command docs on start up, we
+		// do not have any to give
+		w.WriteArrayHeader(0)
+	case "GET":
+		if len(args) != 2 {
+			wrongArgs(w, args[0])
+			return
+		}
+		value, err := s.cache.HandleGet(ctx, args[1])
+		if err != nil {
+			log.Print(err)
+			w.WriteError("ERR failed get")
+			return
+		}
+		if value == nil {
+			w.WriteNull()
+			return
+		}
+		w.WriteBulkString(*value)
+	case "MGET":
+		if len(args) < 2 {
+			wrongArgs(w, args[0])
+			return
+		}
+		values, err := s.cache.HandleMGet(ctx, args[1:])
+		if err != nil {
+			log.Print(err)
+			w.WriteError("ERR failed mget")
+			return
+		}
+		w.WriteArrayHeader(len(values))
+		for _, value := range values {
+			if value == nil {
+				w.WriteNull()
+			} else {
+				w.WriteBulkString(value.Value)
+			}
+		}
+	case "SET":
+		if len(args) < 3 {
+			wrongArgs(w, args[0])
+			return
+		}
+		ttl, err := parseSetTTL(args[3:])
+		if err != nil {
+			w.WriteError(err.Error())
+			return
+		}
+		err = s.cache.HandlePut(ctx, args[1], args[2], ttl)
+		if err != nil {
+			log.Print(err)
+			w.WriteError("ERR failed set")
+			return
+		}
+		w.WriteSimpleString("OK")
+	case "MSET":
+		if len(args) < 3 || len(args)%2 != 1 {
+			wrongArgs(w, args[0])
+			return
+		}
+		var keys []string
+		var values []ValueStore
+		for i := 1; i < len(args); i += 2 {
+			keys = append(keys, args[i])
+			values = append(values, ValueStore{Value: args[i+1]})
+		}
+		// MSET is atomic in redis too
+		for _, err := range s.cache.HandleMSet(ctx, keys, values, 0, true) {
+			switch {
+			case err == errCrossSlot:
+				w.WriteError("CROSSSLOT Keys in request don't hash to the same slot")
+				return
+			case err == errMemcachedAtomic:
+				w.WriteError("ERR MSET is atomic and the memcached backend has no transactions, use SET for each key")
+				return
+			case err != nil:
+				log.Print(err)
+				w.WriteError("ERR failed mset")
+				return
+			}
+		}
+		w.WriteSimpleString("OK")
+	case "DEL":
+		if len(args) < 2 {
+			wrongArgs(w, args[0])
+			return
+		}
+		var deleted int64
+		for _, key := range args[1:] {
+			ok, err := s.cache.HandleDelete(ctx, key)
+			if err != nil {
+				log.Print(err)
+				w.WriteError("ERR failed del")
+				return
+			}
+			if ok {
+				deleted++
+			}
+		}
+		w.WriteInteger(deleted)
+	default:
+		w.WriteError(fmt.Sprintf("ERR unknown command '%v'", args[0]))
+	}
+}
+
+// hello negotiates the protocol version and replies with a map describing
+// the server, like redis does
+func (s *RESPServer) hello(w *resp.Writer, client *respClient, args []string) {
+	proto := client.proto
+	if len(args) > 1 {
+		v, err := strconv.Atoi(args[1])
+		if err != nil {
+			w.WriteError("ERR Protocol version is not an integer or out of range")
+			return
+		}
+		if v != resp.RESP2 && v != resp.RESP3 {
+			w.WriteError("NOPROTO unsupported protocol version")
+			return
+		}
+		proto = v
+
+		// the proxy has no users, so credentials are accepted as is
+		for i := 2; i < len(args); i++ {
+			switch {
+			case strings.EqualFold(args[i], "AUTH") && i+2 < len(args):
+				i += 2
+			case strings.EqualFold(args[i], "SETNAME") && i+1 < len(args):
+				i++
+			default:
+				w.WriteError(errSyntax.Error())
+				return
+			}
+		}
+	}
+
+	client.proto = proto
+	w.SetProtocol(proto)
+	w.WriteMapHeader(7)
+	w.WriteBulkString("server")
+	w.WriteBulkString("proxy")
+	w.WriteBulkString("version")
+	w.WriteBulkString(serverVersion)
+	w.WriteBulkString("proto")
+	w.WriteInteger(int64(proto))
+	w.WriteBulkString("id")
+	w.WriteInteger(client.id)
+	w.WriteBulkString("mode")
+	w.WriteBulkString("standalone")
+	w.WriteBulkString("role")
+	w.WriteBulkString("master")
+	w.WriteBulkString("modules")
+	w.WriteArrayHeader(0)
+}
+
+// writeInfo replies with stats about the server. RESP3 clients get a map,
+// RESP2 clients get the text format of the redis INFO command.
+func (s *RESPServer) writeInfo(w *resp.Writer) {
+	fields := [][2]string{
+		{"server", "proxy"},
+		{"version", serverVersion},
+		{"connected_clients", strconv.FormatInt(atomic.LoadInt64(&s.connectedClients), 10)},
+		{"keys", strconv.Itoa(s.cache.Len())},
+		{"max_keys", strconv.Itoa(s.cache.MaxKeys)},
+		{"key_timeout_ms", strconv.FormatInt(s.cache.KeyTimeout.Milliseconds(), 10)},
+		{"coalesced_gets", strconv.FormatUint(s.cache.CoalescedGets(), 10)},
+	}
+
+	if w.Protocol() == resp.RESP3 {
+		w.WriteMapHeader(len(fields))
+		for _, f := range fields {
+			w.WriteBulkString(f[0])
+			w.WriteBulkString(f[1])
+		}
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString("# Proxy\r\n")
+	for _, f := range fields {
+		b.WriteString(f[0] + ":" + f[1] + "\r\n")
+	}
+	w.WriteBulkString(b.String())
+}
+
+// parseSetTTL reads the EX seconds or PX milliseconds option of SET. Other
+// options are not supported, so anything else is a syntax error.
+func parseSetTTL(opts []string) (time.Duration, error) {
+	if len(opts) == 0 {
+		return 0, nil
+	}
+	if len(opts) != 2 {
+		return 0, errSyntax
+	}
+	unit := time.Second
+	switch strings.ToUpper(opts[0]) {
+	case "EX":
+	case "PX":
+		unit = time.Millisecond
+	default:
+		return 0, errSyntax
+	}
+	n, err := strconv.ParseInt(opts[1], 10, 64)
+	if err != nil {
+		return 0, errors.New("ERR value is not an integer or out of range")
+	}
+	if n <= 0 {
+		return 0, errors.New("ERR invalid expire time in 'set' command")
+	}
+	return time.Duration(n) * unit, nil
+}
+
+func wrongArgs(w *resp.Writer, name string) {
+	w.WriteError(fmt.Sprintf("ERR wrong number of arguments for '%v' command", strings.ToLower(name)))
+}
@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cat-turner/proxy/resp"
+	redis "github.com/go-redis/redis/v8"
+	assert "github.com/stretchr/testify/assert"
+)
+
+// startRESPServer serves the proxy on a random local port and returns a redis
+// client that talks to the proxy rather than to redis
+func startRESPServer(t *testing.T, pc *ProxyCache) *redis.Client {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go NewRESPServer(pc, 0).Serve(l)
+	t.Cleanup(func() { l.Close() })
+
+	client := redis.NewClient(&redis.Options{Addr: l.Addr().String()})
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestRESPServer(t *testing.T) {
+	redisBackends(t, func(t *testing.T, config Config) {
+		assert := assert.New(t)
+
+		proxy, redisClient := newRedisProxy(t, config)
+
+		var ctx = context.Background()
+
+		redisClient.Del(ctx, "ozzy", "ziggy")
+		err := redisClient.Set(ctx, "ozzy", "barks", 0).Err()
+		assert.NoError(err)
+
+		// any redis client can now use the proxy as if it was redis
+		proxyClient := startRESPServer(t, proxy)
+
+		pong, err := proxyClient.Ping(ctx).Result()
+		assert.NoError(err)
+		assert.Equal("PONG", pong)
+
+		value, err := proxyClient.Get(ctx, "ozzy").Result()
+		assert.NoError(err)
+		assert.Equal("barks", value)
+
+		_, err = proxyClient.Get(ctx, "ziggy").Result()
+		assert.Equal(redis.Nil, err)
+
+		// writes through the proxy land in redis
+		err = proxyClient.Set(ctx, "ziggy", "played guitar", 0).Err()
+		assert.NoError(err)
+		value, err = redisClient.Get(ctx, "ziggy").Result()
+		assert.NoError(err)
+		assert.Equal("played guitar", value)
+
+		// and so does their expiry
+		err = proxyClient.Set(ctx, "ziggy", "played guitar", 5*time.Second).Err()
+		assert.NoError(err)
+		ttl, err := redisClient.PTTL(ctx, "ziggy").Result()
+		assert.NoError(err)
+		assert.InDelta(5*time.Second, ttl, float64(100*time.Millisecond))
+
+		err = proxyClient.Do(ctx, "SET", "ziggy", "played guitar", "KEEPTTL").Err()
+		assert.EqualError(err, "ERR syntax error")
+		err = proxyClient.Do(ctx, "SET", "ziggy", "played guitar", "EX", "0").Err()
+		assert.EqualError(err, "ERR invalid expire time in 'set' command")
+
+		err = proxyClient.MSet(ctx, "pip", "squeak", "merry", "brandybuck").Err()
+		assert.NoError(err)
+		values, err := redisClient.MGet(ctx, "pip", "merry").Result()
+		assert.NoError(err)
+		assert.Equal([]interface{}{"squeak", "brandybuck"}, values)
+		err = proxyClient.Do(ctx, "MSET", "pip").Err()
+		assert.EqualError(err, "ERR wrong number of arguments for 'mset' command")
+
+		values, err = proxyClient.MGet(ctx, "ozzy", "nobody", "ziggy").Result()
+		assert.NoError(err)
+		assert.Equal([]interface{}{"barks", nil, "played guitar"}, values)
+
+		// deletes remove the key from the proxy and redis
+		proxyClient.Get(ctx, "ozzy")
+		deleted, err := proxyClient.Del(ctx, "ozzy", "ziggy", "nobody").Result()
+		assert.NoError(err)
+		assert.Equal(int64(2), deleted)
+		_, err = proxyClient.Get(ctx, "ozzy").Result()
+		assert.Equal(redis.Nil, err)
+		_, err = redisClient.Get(ctx, "ziggy").Result()
+		assert.Equal(redis.Nil, err)
+
+		err = proxyClient.Do(ctx, "NOPE").Err()
+		assert.EqualError(err, "ERR unknown command 'NOPE'")
+	})
+}
+
+func TestRESPServerPipelining(t *testing.T) {
+	redisBackends(t, func(t *testing.T, config Config) {
+		assert := assert.New(t)
+
+		proxy, redisClient := newRedisProxy(t, config)
+
+		var ctx = context.Background()
+
+		keys := []string{"pip", "squeak", "pippin", "merry", "sam"}
+		redisClient.Del(ctx, keys...)
+		for _, k := range keys[1:] {
+			err := redisClient.Set(ctx, k, k+" is a hobbit", 0).Err()
+			assert.NoError(err)
+		}
+
+		proxyClient := startRESPServer(t, proxy)
+
+		// send everything in one round trip, the write in the middle has to be
+		// visible to the reads that come after it
+		cmds, err := proxyClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Get(ctx, "pip")
+			pipe.Set(ctx, "pip", "pip is a hobbit", 0)
+			for i := 0; i < 100; i++ {
+				for _, k := range keys {
+					pipe.Get(ctx, k)
+				}
+			}
+			return nil
+		})
+		assert.Equal(redis.Nil, err)
+		assert.Len(cmds, 502)
+		assert.Equal(redis.Nil, cmds[0].Err())
+		assert.NoError(cmds[1].Err())
+		for i, cmd := range cmds[2:] {
+			k := keys[i%len(keys)]
+			assert.Equal(k+" is a hobbit", cmd.(*redis.StringCmd).Val())
+		}
+	})
+}
+
+func TestRESPServerPipelineLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := &slowCache{value: "is a hobbit"}
+	proxy := newLocalCache(Config{})
+	defer proxy.Close()
+	proxy.cache = backend
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	const limit = 4
+	go NewRESPServer(proxy, limit).Serve(l)
+	proxyClient := redis.NewClient(&redis.Options{Addr: l.Addr().String()})
+	defer proxyClient.Close()
+
+	// many more misses than the limit, each of them waits on redis
+	var ctx = context.Background()
+	start := time.Now()
+	cmds, err := proxyClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i := 0; i < 10*limit; i++ {
+			pipe.Get(ctx, fmt.Sprintf("hobbit%d", i))
+		}
+		return nil
+	})
+	elapsed := time.Since(start)
+	assert.NoError(err)
+	assert.Len(cmds, 10*limit)
+	for _, cmd := range cmds {
+		assert.Equal("is a hobbit", cmd.(*redis.StringCmd).Val())
+	}
+
+	// the reads ran alongside each other, but the server stopped reading
+	// commands once the limit was in flight, besides the one whose reply
+	// is being written
+	assert.Less(int64(1), atomic.LoadInt64(&backend.maxRunning))
+	assert.GreaterOrEqual(int64(limit+1), atomic.LoadInt64(&backend.maxRunning))
+	assert.Equal(int64(10*limit), atomic.LoadInt64(&backend.gets))
+	assert.Less(int64(elapsed), int64(10*limit*50*time.Millisecond))
+}
+
+func TestRESPServerHello(t *testing.T) {
+	redisBackends(t, func(t *testing.T, config Config) {
+		assert := assert.New(t)
+
+		proxy, redisClient := newRedisProxy(t, config)
+
+		var ctx = context.Background()
+		redisClient.Del(ctx, "nobody")
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.NoError(err)
+		defer l.Close()
+		go NewRESPServer(proxy, 0).Serve(l)
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		assert.NoError(err)
+		defer conn.Close()
+		r := resp.NewReader(conn)
+		w := resp.NewWriter(conn)
+
+		// clients start out with RESP2
+		w.WriteCommand("GET", "nobody")
+		w.Flush()
+		v, err := r.ReadValue()
+		assert.NoError(err)
+		assert.Equal(byte(resp.BulkString), v.Type)
+		assert.True(v.Null)
+
+		w.WriteCommand("HELLO", "4")
+		w.Flush()
+		v, err = r.ReadValue()
+		assert.NoError(err)
+		assert.Equal("NOPROTO unsupported protocol version", v.Str)
+
+		w.WriteCommand("HELLO", "3", "SETNAME")
+		w.Flush()
+		v, err = r.ReadValue()
+		assert.NoError(err)
+		assert.Equal(errSyntax.Error(), v.Str)
+
+		w.WriteCommand("HELLO", "3", "SETNAME", "roxi")
+		w.Flush()
+		v, err = r.ReadValue()
+		assert.NoError(err)
+		assert.Equal(byte(resp.Map), v.Type)
+		assert.Equal("proto", v.Array[4].Str)
+		assert.Equal(int64(3), v.Array[5].Int)
+
+		// after HELLO 3 misses are RESP3 nulls and INFO is a map
+		w.WriteCommand("GET", "nobody")
+		w.WriteCommand("INFO")
+		w.Flush()
+		v, err = r.ReadValue()
+		assert.NoError(err)
+		assert.Equal(byte(resp.Null), v.Type)
+		v, err = r.ReadValue()
+		assert.NoError(err)
+		assert.Equal(byte(resp.Map), v.Type)
+		assert.Equal("server", v.Array[0].Str)
+		assert.Equal("proxy", v.Array[1].Str)
+	})
+}
@@ -0,0 +1,238 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// cacheShard holds part of the key space of a ProxyCache. Every shard has its
+// own lock, eviction policy and expiry queue, so keys in different shards
+// never wait on each other.
+type cacheShard struct {
+	data map[string]ValueStore
+	mux  *sync.Mutex
+
+	// maxKeys is this shard's part of ProxyCache.MaxKeys, zero means no limit
+	maxKeys int
+
+	// policy picks the key to evict when maxKeys is reached
+	policy EvictionPolicy
+
+	// expiries orders the keys that have an ExpiryTime by when they expire
+	expiries *expiryQueue
+	// wake tells the expiry go routine that a key expires sooner than
+	// it was waiting for
+	wake chan struct{}
+
+	// invalidations counts the keys dropped because they changed in the
+	// external cache
+	invalidations uint64
+}
+
+func newCacheShard(maxKeys int, policy EvictionPolicy) *cacheShard {
+	return &cacheShard{
+		data:     make(map[string]ValueStore),
+		mux:      new(sync.Mutex),
+		maxKeys:  maxKeys,
+		policy:   policy,
+		expiries: newExpiryQueue(),
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// put stores value for key, it expires at value.ExpiryTime unless that is
+// zero
+func (s *cacheShard) put(key string, value ValueStore) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.store(key, value)
+}
+
+// putUnlessInvalidated stores value for key like put, unless a key in the
+// shard was invalidated after generation returned gen
+func (s *cacheShard) putUnlessInvalidated(key string, value ValueStore, gen uint64) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.invalidations != gen {
+		return
+	}
+	s.store(key, value)
+}
+
+// store puts value in data, evicting a key if the shard is full. The caller
+// must hold mux.
+func (s *cacheShard) store(key string, value ValueStore) {
+	value.LastRead = time.Now()
+	if _, ok := s.data[key]; ok {
+		s.policy.Access(key)
+		s.data[key] = value
+		s.scheduleExpiry(key, value.ExpiryTime)
+		return
+	}
+
+	// only evict if max key limit set
+	if s.maxKeys != 0 && len(s.data) >= s.maxKeys {
+		if victim, ok := s.policy.Victim(); ok {
+			s.remove(victim)
+		}
+	}
+
+	s.data[key] = value
+	s.policy.Insert(key)
+	s.scheduleExpiry(key, value.ExpiryTime)
+}
+
+// get returns the value for key and records the read
+func (s *cacheShard) get(key string) (ValueStore, bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	value, ok := s.data[key]
+	if !ok {
+		return ValueStore{}, false
+	}
+
+	now := time.Now()
+	if value.expired(now) {
+		// the expiry go routine has not got to it yet, but it is gone
+		// as far as anyone reading is concerned
+		s.remove(key)
+		return ValueStore{}, false
+	}
+
+	value.LastRead = now
+	s.data[key] = value
+	s.policy.Access(key)
+	return value, true
+}
+
+// peek returns what is stored for key without counting it as a read
+func (s *cacheShard) peek(key string) (ValueStore, bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	value, ok := s.data[key]
+	if !ok || value.expired(time.Now()) {
+		return ValueStore{}, false
+	}
+	return value, true
+}
+
+// invalidate removes key because it changed in the external cache and
+// reports whether it was stored
+func (s *cacheShard) invalidate(key string) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	value, ok := s.data[key]
+	s.remove(key)
+	s.invalidations++
+	return ok && !value.expired(time.Now())
+}
+
+// invalidateAll removes every key, for when the external cache can no longer
+// tell us which keys changed
+func (s *cacheShard) invalidateAll() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for key := range s.data {
+		s.remove(key)
+	}
+	s.invalidations++
+}
+
+// generation returns the number of invalidations so far. A value read from
+// the external cache before an invalidation may be the old one, so comparing
+// generations tells whether it is safe to store.
+func (s *cacheShard) generation() uint64 {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return s.invalidations
+}
+
+func (s *cacheShard) len() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return len(s.data)
+}
+
+// remove deletes key from data, the eviction policy and the expiry queue,
+// the caller must hold mux
+func (s *cacheShard) remove(key string) {
+	if _, ok := s.data[key]; ok {
+		s.policy.Remove(key)
+		s.expiries.Unschedule(key)
+		delete(s.data, key)
+	}
+}
+
+// scheduleExpiry queues key to expire at expiryTime, a zero time means the
+// key never expires. The caller must hold mux.
+func (s *cacheShard) scheduleExpiry(key string, expiryTime time.Time) {
+	if expiryTime.IsZero() {
+		s.expiries.Unschedule(key)
+		return
+	}
+	if s.expiries.Schedule(key, expiryTime) {
+		// the go routine may be sleeping until a later key expires
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// expireKeys removes keys as they expire until stop is closed. It sleeps
+// until the first key in the expiry queue is due, so it only ever touches keys
+// that have expired.
+func (s *cacheShard) expireKeys(stop chan struct{}) {
+	timer := time.NewTimer(0)
+	for {
+		select {
+		case <-timer.C:
+		case <-s.wake:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		case <-stop:
+			timer.Stop()
+			return
+		}
+
+		s.mux.Lock()
+		for _, k := range s.expiries.PopDue(time.Now()) {
+			s.remove(k)
+		}
+		next, ok := s.expiries.Next()
+		s.mux.Unlock()
+
+		if ok {
+			timer.Reset(time.Until(next))
+		} else {
+			// nothing to expire, wait to be woken by a put
+			timer.Reset(time.Hour)
+		}
+	}
+}
+
+// shardIndex picks the shard for key with FNV-1a, which is cheap and spreads
+// similar keys well
+func shardIndex(key string, n int) int {
+	if n == 1 {
+		return 0
+	}
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return int(h % uint32(n))
+}
@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+
+	assert "github.com/stretchr/testify/assert"
+)
+
+func TestShardedCache(t *testing.T) {
+	assert := assert.New(t)
+
+	capacity := 100
+	shards := 8
+	proxy := newLocalCache(Config{CacheKeyCapacity: &capacity, CacheShards: &shards})
+	defer proxy.Close()
+	assert.Len(proxy.shards, 8)
+
+	for i := 0; i < 1000; i++ {
+		k := strconv.Itoa(i)
+		proxy.Put(k, k)
+		assert.Equal(k, *proxy.Get(k))
+	}
+
+	// every shard filled up its part of the capacity, which add up to
+	// exactly the capacity
+	for i, s := range proxy.shards {
+		if i < 4 {
+			assert.Equal(13, s.len())
+		} else {
+			assert.Equal(12, s.len())
+		}
+	}
+	assert.Equal(100, proxy.Len())
+
+	// there are never more shards than keys
+	capacity = 2
+	small := newLocalCache(Config{CacheKeyCapacity: &capacity, CacheShards: &shards})
+	defer small.Close()
+	assert.Len(small.shards, 2)
+	for i := 0; i < 100; i++ {
+		small.Put(strconv.Itoa(i), "")
+	}
+	assert.Equal(2, small.Len())
+}
+
+func TestSingleShardData(t *testing.T) {
+	assert := assert.New(t)
+
+	// with one shard the keys are in Data, guarded by Mux
+	proxy := newLocalCache(Config{})
+	defer proxy.Close()
+	proxy.Put("roxi", "rocks")
+	proxy.Mux.Lock()
+	assert.Equal("rocks", proxy.Data["roxi"].Value)
+	proxy.Mux.Unlock()
+}
+
+func TestInvalidateDuringRead(t *testing.T) {
+	assert := assert.New(t)
+
+	proxy := newLocalCache(Config{})
+	defer proxy.Close()
+	s := proxy.shard("roxi")
+
+	// a value read before an invalidation arrived is not stored
+	gen := s.generation()
+	proxy.Invalidate("roxi")
+	s.putUnlessInvalidated("roxi", ValueStore{Value: "rocks"}, gen)
+	_, ok := proxy.Peek("roxi")
+	assert.False(ok)
+
+	gen = s.generation()
+	s.putUnlessInvalidated("roxi", ValueStore{Value: "rocks"}, gen)
+	assert.Equal("rocks", *proxy.Get("roxi"))
+
+	// nor is one read before the key was deleted
+	gen = s.generation()
+	assert.True(proxy.Delete("roxi"))
+	s.putUnlessInvalidated("roxi", ValueStore{Value: "rocks"}, gen)
+	_, ok = proxy.Peek("roxi")
+	assert.False(ok)
+	assert.False(proxy.Delete("roxi"))
+
+	proxy.Put("tita", "is cool")
+	proxy.InvalidateAll()
+	assert.Equal(0, proxy.Len())
+}
+
+func TestShardIndex(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(0, shardIndex("roxi", 1))
+
+	counts := make([]int, 16)
+	for i := 0; i < 16000; i++ {
+		idx := shardIndex("user:"+strconv.Itoa(i), 16)
+		assert.Equal(idx, shardIndex("user:"+strconv.Itoa(i), 16))
+		counts[idx]++
+	}
+	for _, n := range counts {
+		assert.InDelta(1000, n, 200)
+	}
+}
+
+// BenchmarkProxyCache compares the cache with a single shard, which is the
+// same as one mutex for the whole cache, against sharded caches. Run it with
+// -cpu 1,4,8 to see how each scales with GOMAXPROCS.
+func BenchmarkProxyCache(b *testing.B) {
+	keys := make([]string, 4096)
+	for i := range keys {
+		keys[i] = "key:" + strconv.Itoa(i)
+	}
+
+	for _, shards := range []int{1, 16, 64} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			capacity := len(keys) / 2
+			proxy := newLocalCache(Config{CacheKeyCapacity: &capacity, CacheShards: &shards})
+			defer proxy.Close()
+
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					k := keys[i%len(keys)]
+					// mostly reads, like a read-through cache sees
+					if i%10 == 0 {
+						proxy.Put(k, k)
+					} else {
+						proxy.Get(k)
+					}
+					i++
+				}
+			})
+		})
+	}
+}
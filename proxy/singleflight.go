@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// flightGroup collapses concurrent fetches of the same key into one. The
+// first caller starts the fetch and everyone who asks for the key while it is
+// running gets the same result.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flight
+}
+
+// flight is a fetch that is running or has finished
+type flight struct {
+	done  chan struct{}
+	value *ValueStore
+	err   error
+
+	// waiters counts the callers still waiting for the fetch, it is
+	// cancelled when the last of them gives up
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// Do runs fn for key unless a call for key is already running, in which case
+// it waits for that call and returns its result. shared is true when the
+// result came from another caller's call.
+//
+// Other callers may be waiting for fn, so it gets the values of the first
+// caller's ctx but not its deadline. It is cancelled once every caller has
+// given up, so it runs until the latest deadline among the callers and a
+// caller that joins with more time is not cut short by the one that started
+// it. Each caller, the first one too, stops waiting when its own ctx is done.
+func (g *flightGroup) Do(ctx context.Context, key string, fn func(ctx context.Context) (*ValueStore, error)) (value *ValueStore, err error, shared bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flight)
+	}
+	f, shared := g.calls[key]
+	if !shared {
+		f = &flight{done: make(chan struct{})}
+		var fctx context.Context
+		fctx, f.cancel = context.WithCancel(detachedContext{ctx})
+		g.calls[key] = f
+		go func() {
+			f.value, f.err = fn(fctx)
+			f.cancel()
+			g.mu.Lock()
+			if g.calls[key] == f {
+				delete(g.calls, key)
+			}
+			g.mu.Unlock()
+			close(f.done)
+		}()
+	}
+	f.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-f.done:
+		return f.value, f.err, shared
+	case <-ctx.Done():
+		g.mu.Lock()
+		f.waiters--
+		if f.waiters == 0 {
+			// nobody wants the result any more, and whoever asks for
+			// the key next starts a new fetch
+			f.cancel()
+			if g.calls[key] == f {
+				delete(g.calls, key)
+			}
+		}
+		g.mu.Unlock()
+		return nil, ctx.Err(), shared
+	}
+}
+
+// detachedContext has the values of a context but no deadline and is never
+// done, Do adds the cancellation it shares between its callers
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
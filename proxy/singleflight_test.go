@@ -0,0 +1,210 @@
+package proxy
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	assert "github.com/stretchr/testify/assert"
+)
+
+// slowCache is an external cache that takes a while to answer and counts how
+// often it is asked for a key, and the most reads it had running at once
+type slowCache struct {
+	value string
+	gets  int64
+
+	running    int64
+	maxRunning int64
+}
+
+func (s *slowCache) Put(ctx context.Context, key string, value string, ttl time.Duration) error {
+	return nil
+}
+
+func (s *slowCache) MGet(ctx context.Context, keys []string) ([]*Item, error) {
+	atomic.AddInt64(&s.gets, 1)
+	running := atomic.AddInt64(&s.running, 1)
+	defer atomic.AddInt64(&s.running, -1)
+	for {
+		max := atomic.LoadInt64(&s.maxRunning)
+		if running <= max || atomic.CompareAndSwapInt64(&s.maxRunning, max, running) {
+			break
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	items := make([]*Item, len(keys))
+	for i, key := range keys {
+		// it has every key, but no content types
+		if !strings.HasSuffix(key, contentTypeSuffix) {
+			items[i] = &Item{Value: s.value}
+		}
+	}
+	return items, nil
+}
+
+func (s *slowCache) MSet(ctx context.Context, keys []string, values []string, ttl time.Duration, atomic bool) []error {
+	return make([]error, len(keys))
+}
+
+func (s *slowCache) Delete(ctx context.Context, key string) (bool, error) {
+	return false, nil
+}
+
+func (s *slowCache) MDelete(ctx context.Context, keys []string) ([]bool, error) {
+	return make([]bool, len(keys)), nil
+}
+
+func (s *slowCache) Exists(ctx context.Context, key string) (bool, error) {
+	return true, nil
+}
+
+func (s *slowCache) TTL(ctx context.Context, key string) (time.Duration, bool, error) {
+	return 0, true, nil
+}
+
+func (s *slowCache) Get(ctx context.Context, key string) (*string, error) {
+	atomic.AddInt64(&s.gets, 1)
+	time.Sleep(50 * time.Millisecond)
+	value := s.value
+	return &value, nil
+}
+
+func TestFlightGroup(t *testing.T) {
+	assert := assert.New(t)
+
+	var ctx = context.Background()
+	var g flightGroup
+	var calls int64
+	release := make(chan struct{})
+
+	var wg sync.WaitGroup
+	var shared int64
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, err, s := g.Do(ctx, "roxi", func(ctx context.Context) (*ValueStore, error) {
+				atomic.AddInt64(&calls, 1)
+				<-release
+				return &ValueStore{Value: "rocks"}, nil
+			})
+			assert.NoError(err)
+			assert.Equal("rocks", value.Value)
+			if s {
+				atomic.AddInt64(&shared, 1)
+			}
+		}()
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(int64(1), calls)
+	assert.Equal(int64(9), shared)
+
+	// once the call is done the next one runs again
+	g.Do(ctx, "roxi", func(ctx context.Context) (*ValueStore, error) {
+		atomic.AddInt64(&calls, 1)
+		return nil, nil
+	})
+	assert.Equal(int64(2), calls)
+
+	// a caller that gives up stops waiting, without cancelling the call
+	// for the others
+	release = make(chan struct{})
+	done := make(chan error)
+	go func() {
+		_, err, _ := g.Do(ctx, "roxi", func(ctx context.Context) (*ValueStore, error) {
+			<-release
+			return &ValueStore{Value: "rocks"}, ctx.Err()
+		})
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err, s := g.Do(cancelled, "roxi", nil)
+	assert.Equal(context.Canceled, err)
+	assert.True(s)
+	close(release)
+	assert.NoError(<-done)
+
+	// the call is cancelled once every caller has given up
+	cancelled, cancel = context.WithCancel(ctx)
+	called := make(chan context.Context, 1)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	_, err, _ = g.Do(cancelled, "roxi", func(ctx context.Context) (*ValueStore, error) {
+		called <- ctx
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	assert.Equal(context.Canceled, err)
+	select {
+	case fctx := <-called:
+		<-fctx.Done()
+		assert.Equal(context.Canceled, fctx.Err())
+	case <-time.After(time.Second):
+		t.Fatal("the call never ran")
+	}
+
+	// a caller that joins with a later deadline still gets the result
+	// after the one that started the call has run out of time
+	short, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	long, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	started := make(chan struct{})
+	first := make(chan error)
+	go func() {
+		_, err, _ := g.Do(short, "roxi", func(ctx context.Context) (*ValueStore, error) {
+			close(started)
+			select {
+			case <-time.After(60 * time.Millisecond):
+				return &ValueStore{Value: "rocks"}, nil
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		})
+		first <- err
+	}()
+	<-started
+	value, err, s := g.Do(long, "roxi", nil)
+	assert.NoError(err)
+	assert.True(s)
+	if assert.NotNil(value) {
+		assert.Equal("rocks", value.Value)
+	}
+	assert.Equal(context.DeadlineExceeded, <-first)
+}
+
+func TestHandleGetCoalescesMisses(t *testing.T) {
+	assert := assert.New(t)
+
+	backend := &slowCache{value: "is cool"}
+	proxy := newLocalCache(Config{})
+	defer proxy.Close()
+	proxy.cache = backend
+
+	// a stampede of requests for a key the proxy does not have
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			value, err := proxy.HandleGet(context.Background(), "tita")
+			assert.NoError(err)
+			assert.Equal("is cool", *value)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(int64(1), atomic.LoadInt64(&backend.gets))
+	assert.Equal(uint64(19), proxy.CoalescedGets())
+}
@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"fmt"
+	"hash/maphash"
+)
+
+const (
+	// sketchDepth is the number of rows in the count-min sketch, each row
+	// hashes keys differently and the smallest count wins
+	sketchDepth = 4
+	// sketchMaxCount is where counters stop, like the 4 bit counters of the
+	// TinyLFU paper. Popular keys stay popular without overflowing.
+	sketchMaxCount = 15
+	// windowPercent is the share of the cache given to the window LRU
+	windowPercent = 1
+	// sketchWidthFactor is the number of counters per row for every key the
+	// cache holds. Fewer counters make cold keys share counters often enough
+	// to look as popular as hot keys.
+	sketchWidthFactor = 4
+)
+
+// NewAdmissionPolicy wraps an eviction policy with the named admission
+// filter. The only filter is tinylfu; an empty name returns main as is.
+// capacity is the number of keys the cache holds.
+func NewAdmissionPolicy(name string, main EvictionPolicy, capacity int) (EvictionPolicy, error) {
+	switch name {
+	case "":
+		return main, nil
+	case "tinylfu":
+		return newTinyLFUPolicy(main, capacity), nil
+	}
+	return nil, fmt.Errorf("unknown admission policy %q", name)
+}
+
+// tinyLFUPolicy is a W-TinyLFU admission filter in front of another
+// eviction policy.
+//
+// New keys land in a small window LRU. When the window is full, the key
+// leaving it has to compete with the victim of the main policy for a place in
+// the cache, and it only gets in when the sketch says it is used more often
+// than the victim. A scan over cold keys churns through the window but can not
+// push hot keys out of the main part of the cache.
+type tinyLFUPolicy struct {
+	sketch    *countMinSketch
+	window    *lruPolicy
+	windowCap int
+	main      EvictionPolicy
+}
+
+func newTinyLFUPolicy(main EvictionPolicy, capacity int) *tinyLFUPolicy {
+	windowCap := capacity * windowPercent / 100
+	if windowCap < 1 {
+		windowCap = 1
+	}
+	return &tinyLFUPolicy{
+		sketch:    newCountMinSketch(capacity),
+		window:    newLRUPolicy(),
+		windowCap: windowCap,
+		main:      main,
+	}
+}
+
+func (p *tinyLFUPolicy) Access(key string) {
+	p.sketch.Increment(key)
+	if _, ok := p.window.elements[key]; ok {
+		p.window.Access(key)
+		return
+	}
+	p.main.Access(key)
+}
+
+// Insert puts key in the window. A key pushed out of the window moves to the
+// main policy, Victim has already made room for it there.
+func (p *tinyLFUPolicy) Insert(key string) {
+	p.sketch.Increment(key)
+	p.window.Insert(key)
+	if len(p.window.elements) > p.windowCap {
+		candidate, _ := p.window.Victim()
+		p.window.Remove(candidate)
+		p.main.Insert(candidate)
+	}
+}
+
+func (p *tinyLFUPolicy) Remove(key string) {
+	if _, ok := p.window.elements[key]; ok {
+		p.window.Remove(key)
+		return
+	}
+	p.main.Remove(key)
+}
+
+// Victim is called before a new key is inserted. If the window is full the
+// new key will push its oldest key out, so that key and the victim of the
+// main policy are compared and the less popular of the two is evicted.
+func (p *tinyLFUPolicy) Victim() (string, bool) {
+	victim, ok := p.main.Victim()
+	if !ok {
+		return p.window.Victim()
+	}
+	if len(p.window.elements) < p.windowCap {
+		return victim, true
+	}
+
+	candidate, _ := p.window.Victim()
+	if p.sketch.Estimate(candidate) > p.sketch.Estimate(victim) {
+		return victim, true
+	}
+	return candidate, true
+}
+
+// countMinSketch estimates how often keys were seen in a fixed amount of
+// memory. Estimates can be too high when keys collide but never too low.
+//
+// Counts are halved once the sketch has seen ten times as many keys as the
+// cache holds, so keys that were popular a long time ago fade out.
+type countMinSketch struct {
+	rows      [sketchDepth][]uint8
+	mask      uint64
+	seed      maphash.Seed
+	additions int
+	resetAt   int
+}
+
+func newCountMinSketch(capacity int) *countMinSketch {
+	width := 16
+	for width < sketchWidthFactor*capacity {
+		width *= 2
+	}
+	s := &countMinSketch{
+		mask:    uint64(width - 1),
+		seed:    maphash.MakeSeed(),
+		resetAt: 10 * capacity,
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+// Increment counts one more sighting of key
+func (s *countMinSketch) Increment(key string) {
+	h := s.hash(key)
+	for i := range s.rows {
+		h = mix(h)
+		if s.rows[i][h&s.mask] < sketchMaxCount {
+			s.rows[i][h&s.mask]++
+		}
+	}
+
+	s.additions++
+	if s.additions >= s.resetAt {
+		s.reset()
+	}
+}
+
+// Estimate returns how often key has been seen
+func (s *countMinSketch) Estimate(key string) uint8 {
+	h := s.hash(key)
+	min := uint8(sketchMaxCount)
+	for i := range s.rows {
+		h = mix(h)
+		if c := s.rows[i][h&s.mask]; c < min {
+			min = c
+		}
+	}
+	return min
+}
+
+func (s *countMinSketch) reset() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] /= 2
+		}
+	}
+	s.additions /= 2
+}
+
+func (s *countMinSketch) hash(key string) uint64 {
+	var h maphash.Hash
+	h.SetSeed(s.seed)
+	h.WriteString(key)
+	return h.Sum64()
+}
+
+// mix is the splitmix64 finalizer. Every row mixes the hash of the previous
+// row, so rows index independently without hashing the key again and two
+// keys only share every counter when their 64 bit hashes are equal.
+func mix(h uint64) uint64 {
+	h += 0x9e3779b97f4a7c15
+	h = (h ^ (h >> 30)) * 0xbf58476d1ce4e5b9
+	h = (h ^ (h >> 27)) * 0x94d049bb133111eb
+	return h ^ (h >> 31)
+}
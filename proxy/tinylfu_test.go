@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"strconv"
+	"testing"
+
+	assert "github.com/stretchr/testify/assert"
+)
+
+func TestCountMinSketch(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newCountMinSketch(100)
+	for i := 0; i < 5; i++ {
+		s.Increment("roxi")
+	}
+	s.Increment("tita")
+
+	assert.True(s.Estimate("roxi") >= 5)
+	assert.True(s.Estimate("tita") >= 1)
+	assert.True(s.Estimate("roxi") > s.Estimate("tita"))
+
+	// counters stop at the max instead of wrapping around
+	for i := 0; i < 100; i++ {
+		s.Increment("heff")
+	}
+	assert.Equal(uint8(sketchMaxCount), s.Estimate("heff"))
+
+	// after enough additions every count is halved
+	for i := 0; i < 1000; i++ {
+		s.Increment(strconv.Itoa(i))
+	}
+	assert.True(s.Estimate("heff") < sketchMaxCount)
+}
+
+func TestNewAdmissionPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	lru := newLRUPolicy()
+	p, err := NewAdmissionPolicy("", lru, 10)
+	assert.NoError(err)
+	assert.Equal(lru, p)
+
+	p, err = NewAdmissionPolicy("tinylfu", lru, 10)
+	assert.NoError(err)
+	assert.IsType(&tinyLFUPolicy{}, p)
+
+	_, err = NewAdmissionPolicy("bouncer", lru, 10)
+	assert.EqualError(err, `unknown admission policy "bouncer"`)
+}
+
+func TestTinyLFUScanResistance(t *testing.T) {
+	assert := assert.New(t)
+
+	capacity := 100
+	lru := newLocalCache(Config{CacheKeyCapacity: &capacity})
+	tinylfu := newLocalCache(Config{CacheKeyCapacity: &capacity, CacheAdmission: "tinylfu"})
+	t.Cleanup(lru.Close)
+	t.Cleanup(tinylfu.Close)
+
+	// a handful of keys that get read all the time
+	hot := []string{"roxi", "tita", "heff", "rocco", "tito"}
+	for _, proxy := range []*ProxyCache{lru, tinylfu} {
+		for _, k := range hot {
+			proxy.Put(k, k)
+			for i := 0; i < 5; i++ {
+				proxy.Get(k)
+			}
+		}
+	}
+
+	// a batch job scans over many more keys than the cache holds
+	for i := 0; i < 5*capacity; i++ {
+		k := "scan-" + strconv.Itoa(i)
+		for _, proxy := range []*ProxyCache{lru, tinylfu} {
+			proxy.Put(k, k)
+		}
+	}
+
+	for _, k := range hot {
+		assert.Nil(lru.Get(k))
+		assert.NotNil(tinylfu.Get(k))
+	}
+	assert.Equal(capacity, lru.Len())
+	assert.Equal(capacity, tinylfu.Len())
+}
+
+func TestTinyLFUAdmitsPopularKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	capacity := 100
+	proxy := newLocalCache(Config{CacheKeyCapacity: &capacity, CacheAdmission: "tinylfu"})
+	t.Cleanup(proxy.Close)
+	for i := 0; i < capacity; i++ {
+		proxy.Put(strconv.Itoa(i), "cold")
+	}
+
+	// a key that keeps missing builds up a count and eventually gets in
+	for i := 0; i < 5; i++ {
+		proxy.Put("roxi", "rocks")
+		proxy.Put("filler-"+strconv.Itoa(i), "cold")
+	}
+	assert.Equal("rocks", *proxy.Get("roxi"))
+	assert.Equal(capacity, proxy.Len())
+}
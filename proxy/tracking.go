@@ -0,0 +1,263 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cat-turner/proxy/resp"
+	redis "github.com/go-redis/redis/v8"
+)
+
+const (
+	// trackingPing is how often the tracking connection is checked, a
+	// connection that has been quiet for three of them is treated as dead
+	trackingPing = 10 * time.Second
+	// trackingRetry is how long to wait before connecting again
+	trackingRetry = time.Second
+)
+
+var errTrackerClosed = errors.New("tracker closed")
+
+// TrackingOptions configures client side caching with CLIENT TRACKING
+type TrackingOptions struct {
+	// Broadcast makes redis report changes to every key starting with one
+	// of Prefixes, instead of only the keys the proxy has read. No prefixes
+	// means every key.
+	Broadcast bool
+	Prefixes  []string
+}
+
+// tracker is the connection redis sends invalidations to. It speaks RESP3,
+// so invalidations arrive as push frames, and it is used for nothing else.
+type tracker struct {
+	addr string
+	opts TrackingOptions
+	// invalidate is called with the keys that changed, nil means every key
+	invalidate func(keys []string)
+
+	mux  sync.Mutex
+	conn net.Conn
+	// reads is the client for commands on keys in default mode, its
+	// connections have redis send invalidations for the keys they read to
+	// conn
+	reads *redis.Client
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// startTracker connects to redis at addr and starts tracking. It returns once
+// tracking is on, after that it reconnects by itself until Close is called.
+func startTracker(addr string, opts TrackingOptions, invalidate func(keys []string)) (*tracker, error) {
+	t := &tracker{
+		addr:       addr,
+		opts:       opts,
+		invalidate: invalidate,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	r, err := t.connect()
+	if err != nil {
+		return nil, err
+	}
+	go t.run(r)
+	return t, nil
+}
+
+// connect opens a new tracking connection and turns tracking on for it
+func (t *tracker) connect() (*resp.Reader, error) {
+	conn, err := net.Dial("tcp", t.addr)
+	if err != nil {
+		return nil, err
+	}
+	r := resp.NewReader(conn)
+	w := resp.NewWriter(conn)
+	w.SetProtocol(resp.RESP3)
+
+	call := func(args ...string) (resp.Value, error) {
+		w.WriteCommand(args...)
+		if err := w.Flush(); err != nil {
+			return resp.Value{}, err
+		}
+		v, err := r.ReadValue()
+		if err == nil && (v.Type == resp.Error || v.Type == resp.BulkError) {
+			err = errors.New(v.Str)
+		}
+		return v, err
+	}
+
+	if _, err := call("HELLO", "3"); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("tracking needs RESP3: %w", err)
+	}
+	id, err := call("CLIENT", "ID")
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	var reads *redis.Client
+	if t.opts.Broadcast {
+		args := []string{"CLIENT", "TRACKING", "on", "BCAST", "NOLOOP"}
+		for _, p := range t.opts.Prefixes {
+			args = append(args, "PREFIX", p)
+		}
+		if _, err := call(args...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	} else {
+		// redis tracks the keys each connection reads, so every
+		// connection reads go through has to redirect to this one.
+		// NOLOOP leaves out the keys a connection writes itself, so a
+		// put does not invalidate the copy the proxy just cached.
+		redirect := strconv.FormatInt(id.Int, 10)
+		reads = redis.NewClient(&redis.Options{
+			Addr: t.addr,
+			OnConnect: func(ctx context.Context, cn *redis.Conn) error {
+				cmd := redis.NewStatusCmd(ctx, "CLIENT", "TRACKING", "on", "REDIRECT", redirect, "NOLOOP")
+				cn.Process(ctx, cmd)
+				return cmd.Err()
+			},
+		})
+	}
+
+	t.mux.Lock()
+	select {
+	case <-t.stop:
+		// Close was called while we were connecting
+		t.mux.Unlock()
+		conn.Close()
+		if reads != nil {
+			reads.Close()
+		}
+		return nil, errTrackerClosed
+	default:
+	}
+	t.conn = conn
+	old := t.reads
+	if reads != nil {
+		t.reads = reads
+	}
+	t.mux.Unlock()
+	if old != nil && reads != nil {
+		// its connections redirect to the connection that was lost
+		old.Close()
+	}
+	return r, nil
+}
+
+// client returns the client for commands on keys in default mode
+func (t *tracker) client() *redis.Client {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	return t.reads
+}
+
+// run reads invalidations until Close is called, connecting again when the
+// connection is lost
+func (t *tracker) run(r *resp.Reader) {
+	defer close(t.done)
+	for {
+		err := t.receive(r)
+		select {
+		case <-t.stop:
+			return
+		default:
+		}
+		log.Print(fmt.Sprintf("tracking connection lost: %v", err))
+
+		for {
+			// invalidations may have been missed while we were not
+			// connected, so nothing cached before can be trusted
+			t.invalidate(nil)
+			r, err = t.connect()
+			if err == nil {
+				break
+			}
+			log.Print(err)
+			select {
+			case <-t.stop:
+				return
+			case <-time.After(trackingRetry):
+			}
+		}
+	}
+}
+
+// receive hands invalidations to the tracker until the connection fails
+func (t *tracker) receive(r *resp.Reader) error {
+	t.mux.Lock()
+	conn := t.conn
+	t.mux.Unlock()
+	defer conn.Close()
+
+	// pings keep a connection that has silently died from going unnoticed
+	pinged := make(chan struct{})
+	defer close(pinged)
+	go func() {
+		w := resp.NewWriter(conn)
+		ticker := time.NewTicker(trackingPing)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-pinged:
+				return
+			case <-ticker.C:
+				w.WriteCommand("PING")
+				w.Flush()
+			}
+		}
+	}()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(3 * trackingPing))
+		v, err := r.ReadValue()
+		if err != nil {
+			return err
+		}
+		if v.Type != resp.Push || len(v.Array) != 2 || v.Array[0].Str != "invalidate" {
+			// replies to our pings
+			continue
+		}
+		keys := v.Array[1]
+		if keys.Null {
+			// redis was flushed
+			t.invalidate(nil)
+			continue
+		}
+		invalidated := make([]string, len(keys.Array))
+		for i, k := range keys.Array {
+			invalidated[i] = k.Str
+		}
+		t.invalidate(invalidated)
+	}
+}
+
+// Close stops tracking, it can be called more than once
+func (t *tracker) Close() error {
+	closed := false
+	t.stopOnce.Do(func() {
+		close(t.stop)
+		closed = true
+	})
+	if !closed {
+		return nil
+	}
+	t.mux.Lock()
+	t.conn.Close()
+	reads := t.reads
+	t.mux.Unlock()
+	<-t.done
+	if reads != nil {
+		return reads.Close()
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Reader reads RESP values from a stream
+type Reader struct {
+	rd *bufio.Reader
+
+	// depth is how many aggregates the value being read is nested in
+	depth int
+}
+
+// NewReader creates a Reader that buffers rd
+func NewReader(rd io.Reader) *Reader {
+	return &Reader{rd: bufio.NewReader(rd)}
+}
+
+// ReadCommand reads the next command sent by a client. Commands are either
+// an array of bulk strings or an inline command, which is what you get when
+// you type into telnet or netcat.
+func (r *Reader) ReadCommand() ([]string, error) {
+	for {
+		b, err := r.rd.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] != Array {
+			line, err := r.readLine()
+			if err != nil {
+				return nil, err
+			}
+			args := strings.Fields(line)
+			if len(args) == 0 {
+				// skip empty lines like redis does
+				continue
+			}
+			return args, nil
+		}
+
+		v, err := r.ReadValue()
+		if err != nil {
+			return nil, err
+		}
+		if v.Null || len(v.Array) == 0 {
+			continue
+		}
+		args := make([]string, len(v.Array))
+		for i, a := range v.Array {
+			if a.Type != BulkString || a.Null {
+				return nil, fmt.Errorf("%w: expected bulk string in command", ErrProtocol)
+			}
+			args[i] = a.Str
+		}
+		return args, nil
+	}
+}
+
+// ReadValue reads the next value of any type from the stream
+func (r *Reader) ReadValue() (Value, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return Value{}, err
+	}
+	if len(line) == 0 {
+		return Value{}, fmt.Errorf("%w: empty line", ErrProtocol)
+	}
+
+	v := Value{Type: line[0]}
+	switch v.Type {
+	case SimpleString, Error, Double, BigNumber:
+		v.Str = line[1:]
+	case Integer:
+		v.Int, err = parseInt(line[1:])
+		if err != nil {
+			return Value{}, err
+		}
+	case Null:
+		v.Null = true
+	case Boolean:
+		switch line[1:] {
+		case "t":
+			v.Int = 1
+		case "f":
+		default:
+			return Value{}, fmt.Errorf("%w: invalid boolean %q", ErrProtocol, line)
+		}
+	case BulkError, VerbatimString:
+		n, err := parseInt(line[1:])
+		if err != nil {
+			return Value{}, err
+		}
+		v.Str, err = r.readBulk(n)
+		if err != nil {
+			return Value{}, err
+		}
+	case Set, Push:
+		n, err := parseInt(line[1:])
+		if err != nil {
+			return Value{}, err
+		}
+		v.Array, err = r.readValues(n)
+		if err != nil {
+			return Value{}, err
+		}
+	case Map:
+		n, err := parseInt(line[1:])
+		if err != nil {
+			return Value{}, err
+		}
+		v.Array, err = r.readValues(2 * n)
+		if err != nil {
+			return Value{}, err
+		}
+	case Attribute:
+		// attributes describe the reply that follows them, nothing we
+		// need, so skip over them
+		n, err := parseInt(line[1:])
+		if err != nil {
+			return Value{}, err
+		}
+		if _, err := r.readValues(2 * n); err != nil {
+			return Value{}, err
+		}
+		return r.ReadValue()
+	case BulkString:
+		n, err := parseInt(line[1:])
+		if err != nil {
+			return Value{}, err
+		}
+		if n < 0 {
+			v.Null = true
+			return v, nil
+		}
+		v.Str, err = r.readBulk(n)
+		if err != nil {
+			return Value{}, err
+		}
+	case Array:
+		n, err := parseInt(line[1:])
+		if err != nil {
+			return Value{}, err
+		}
+		if n < 0 {
+			v.Null = true
+			return v, nil
+		}
+		v.Array, err = r.readValues(n)
+		if err != nil {
+			return Value{}, err
+		}
+	default:
+		return Value{}, fmt.Errorf("%w: unknown type %q", ErrProtocol, v.Type)
+	}
+	return v, nil
+}
+
+// Buffered returns the number of bytes that have been received but not read
+// yet. A non-zero value means the peer has pipelined more data.
+func (r *Reader) Buffered() int {
+	return r.rd.Buffered()
+}
+
+func (r *Reader) readValues(n int64) ([]Value, error) {
+	if n < 0 || n > maxMultiBulkLen {
+		return nil, fmt.Errorf("%w: too many elements", ErrProtocol)
+	}
+	if r.depth >= maxDepth {
+		return nil, fmt.Errorf("%w: values nested too deeply", ErrProtocol)
+	}
+	r.depth++
+	defer func() { r.depth-- }()
+
+	// n is only what the peer claims, so values grow as they arrive
+	var values []Value
+	for i := int64(0); i < n; i++ {
+		v, err := r.ReadValue()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+func (r *Reader) readBulk(n int64) (string, error) {
+	if n < 0 || n > maxBulkLen {
+		return "", fmt.Errorf("%w: invalid bulk length", ErrProtocol)
+	}
+	// n is only what the peer claims, so the buffer grows as the bytes
+	// arrive
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, r.rd, n+2); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	b := buf.Bytes()
+	if b[n] != '\r' || b[n+1] != '\n' {
+		return "", fmt.Errorf("%w: bulk string not terminated by CRLF", ErrProtocol)
+	}
+	return string(b[:n]), nil
+}
+
+// readLine reads a line terminated by CRLF and strips the terminator. A bare
+// LF is accepted too so that inline commands work from netcat.
+func (r *Reader) readLine() (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.rd.ReadSlice('\n')
+		// the limit leaves room for the CRLF
+		if len(line)+len(chunk) > maxLineLen+2 {
+			return "", fmt.Errorf("%w: line too long", ErrProtocol)
+		}
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		break
+	}
+	return strings.TrimSuffix(string(line[:len(line)-1]), "\r"), nil
+}
+
+func parseInt(s string) (int64, error) {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid integer %q", ErrProtocol, s)
+	}
+	return n, nil
+}
@@ -0,0 +1,68 @@
+// Package resp implements the parts of the Redis serialization protocol
+// (RESP) needed to speak to Redis clients and servers.
+package resp
+
+import "errors"
+
+// RESP2 type prefixes
+const (
+	SimpleString = '+'
+	Error        = '-'
+	Integer      = ':'
+	BulkString   = '$'
+	Array        = '*'
+)
+
+// RESP3 type prefixes, only sent to clients that asked for them with HELLO 3
+const (
+	Null           = '_'
+	Boolean        = '#'
+	Double         = ','
+	BigNumber      = '('
+	BulkError      = '!'
+	VerbatimString = '='
+	Map            = '%'
+	Set            = '~'
+	Attribute      = '|'
+	Push           = '>'
+)
+
+// Protocol versions that can be negotiated with HELLO
+const (
+	RESP2 = 2
+	RESP3 = 3
+)
+
+// maxBulkLen mirrors the default proto-max-bulk-len of redis so that a bad
+// length prefix can not make us allocate an unbounded amount of memory
+const maxBulkLen = 512 * 1024 * 1024
+
+// maxMultiBulkLen mirrors the limit redis puts on the number of elements of
+// a multibulk, every element still has to arrive before it takes up memory
+const maxMultiBulkLen = 1024 * 1024
+
+// maxDepth is how deeply aggregates may nest, so a stream of array headers
+// can not grow the stack without bound
+const maxDepth = 128
+
+// maxLineLen is the longest inline command or simple line we read, 64KB like
+// the inline commands of redis, so a client that never sends a newline can
+// not make us buffer it all
+const maxLineLen = 64 * 1024
+
+// ErrProtocol is returned when the stream does not contain valid RESP
+var ErrProtocol = errors.New("resp: protocol error")
+
+// Value is a single RESP value read from a stream
+type Value struct {
+	Type byte
+	// Str holds strings, errors, doubles and big numbers as sent
+	Str string
+	// Int holds integers, and booleans as 0 or 1
+	Int int64
+	// Array holds the elements of arrays, sets and pushes. For maps it
+	// holds the keys and values interleaved.
+	Array []Value
+	// Null is set for RESP3 nulls and RESP2 null bulk strings and arrays
+	Null bool
+}
@@ -0,0 +1,205 @@
+package resp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+
+	assert "github.com/stretchr/testify/assert"
+)
+
+func TestReadCommand(t *testing.T) {
+	assert := assert.New(t)
+
+	// a command sent by a client library followed by one typed into netcat
+	r := NewReader(strings.NewReader("*2\r\n$3\r\nGET\r\n$5\r\nro\r\nx\r\n\r\nSET roxi rocks\n"))
+
+	args, err := r.ReadCommand()
+	assert.NoError(err)
+	assert.Equal([]string{"GET", "ro\r\nx"}, args)
+
+	args, err = r.ReadCommand()
+	assert.NoError(err)
+	assert.Equal([]string{"SET", "roxi", "rocks"}, args)
+
+	_, err = r.ReadCommand()
+	assert.Error(err)
+}
+
+func TestReadCommandProtocolError(t *testing.T) {
+	assert := assert.New(t)
+
+	r := NewReader(strings.NewReader("*1\r\n:1\r\n"))
+	_, err := r.ReadCommand()
+	assert.True(errors.Is(err, ErrProtocol))
+
+	r = NewReader(strings.NewReader("*1\r\n$3\r\nGETXX"))
+	_, err = r.ReadCommand()
+	assert.True(errors.Is(err, ErrProtocol))
+
+	// inline commands and simple lines are at most 64KB, like in redis
+	long := strings.Repeat("x", maxLineLen)
+	r = NewReader(strings.NewReader("GET " + long + "\r\n"))
+	_, err = r.ReadCommand()
+	assert.True(errors.Is(err, ErrProtocol))
+	r = NewReader(strings.NewReader("+" + long + "\r\n"))
+	_, err = r.ReadValue()
+	assert.True(errors.Is(err, ErrProtocol))
+
+	r = NewReader(strings.NewReader("GET " + long[4:] + "\r\n"))
+	args, err := r.ReadCommand()
+	assert.NoError(err)
+	assert.Equal([]string{"GET", long[4:]}, args)
+}
+
+func TestReadHostileLengths(t *testing.T) {
+	assert := assert.New(t)
+
+	// more elements than redis allows in a multibulk
+	r := NewReader(strings.NewReader("*500000000\r\n"))
+	_, err := r.ReadCommand()
+	assert.True(errors.Is(err, ErrProtocol))
+	r = NewReader(strings.NewReader("%300000000\r\n"))
+	_, err = r.ReadValue()
+	assert.True(errors.Is(err, ErrProtocol))
+
+	// lengths within the limits that are never sent take no memory up front
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	r = NewReader(strings.NewReader("*1048576\r\n$3\r\nGET\r\n"))
+	_, err = r.ReadCommand()
+	assert.Equal(io.ErrUnexpectedEOF, err)
+	r = NewReader(strings.NewReader("*2\r\n$3\r\nGET\r\n$500000000\r\nroxi"))
+	_, err = r.ReadCommand()
+	assert.Equal(io.ErrUnexpectedEOF, err)
+	runtime.ReadMemStats(&after)
+	assert.Less(after.TotalAlloc-before.TotalAlloc, uint64(1<<20))
+
+	// nor can nesting grow without bound
+	r = NewReader(strings.NewReader(strings.Repeat("*1\r\n", maxDepth+1) + ":1\r\n"))
+	_, err = r.ReadValue()
+	assert.True(errors.Is(err, ErrProtocol))
+	r = NewReader(strings.NewReader(strings.Repeat("*1\r\n", maxDepth) + ":1\r\n"))
+	_, err = r.ReadValue()
+	assert.NoError(err)
+}
+
+func TestReadValue(t *testing.T) {
+	assert := assert.New(t)
+
+	r := NewReader(strings.NewReader("+OK\r\n-ERR nope\r\n:42\r\n$-1\r\n*2\r\n$1\r\na\r\n*-1\r\n"))
+
+	v, err := r.ReadValue()
+	assert.NoError(err)
+	assert.Equal(Value{Type: SimpleString, Str: "OK"}, v)
+
+	v, err = r.ReadValue()
+	assert.NoError(err)
+	assert.Equal(Value{Type: Error, Str: "ERR nope"}, v)
+
+	v, err = r.ReadValue()
+	assert.NoError(err)
+	assert.Equal(Value{Type: Integer, Int: 42}, v)
+
+	v, err = r.ReadValue()
+	assert.NoError(err)
+	assert.True(v.Null)
+
+	v, err = r.ReadValue()
+	assert.NoError(err)
+	assert.Equal(byte(Array), v.Type)
+	assert.Equal("a", v.Array[0].Str)
+	assert.True(v.Array[1].Null)
+}
+
+func TestWriter(t *testing.T) {
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.WriteSimpleString("OK")
+	w.WriteError("ERR nope")
+	w.WriteInteger(-3)
+	w.WriteBulkString("rocks")
+	w.WriteNull()
+	w.WriteCommand("GET", "roxi")
+	assert.Equal(0, buf.Len())
+
+	assert.NoError(w.Flush())
+	assert.Equal("+OK\r\n-ERR nope\r\n:-3\r\n$5\r\nrocks\r\n$-1\r\n*2\r\n$3\r\nGET\r\n$4\r\nroxi\r\n", buf.String())
+}
+
+func TestReadRESP3Value(t *testing.T) {
+	assert := assert.New(t)
+
+	r := NewReader(strings.NewReader("_\r\n#t\r\n,3.14\r\n%1\r\n$5\r\nproto\r\n:3\r\n|1\r\n+ttl\r\n:5\r\n>2\r\n$10\r\ninvalidate\r\n*1\r\n$4\r\nroxi\r\n"))
+
+	v, err := r.ReadValue()
+	assert.NoError(err)
+	assert.True(v.Null)
+
+	v, err = r.ReadValue()
+	assert.NoError(err)
+	assert.Equal(Value{Type: Boolean, Int: 1}, v)
+
+	v, err = r.ReadValue()
+	assert.NoError(err)
+	assert.Equal(Value{Type: Double, Str: "3.14"}, v)
+
+	v, err = r.ReadValue()
+	assert.NoError(err)
+	assert.Equal(byte(Map), v.Type)
+	assert.Equal("proto", v.Array[0].Str)
+	assert.Equal(int64(3), v.Array[1].Int)
+
+	// attributes are skipped
+	v, err = r.ReadValue()
+	assert.NoError(err)
+	assert.Equal(byte(Push), v.Type)
+	assert.Equal("invalidate", v.Array[0].Str)
+	assert.Equal("roxi", v.Array[1].Array[0].Str)
+}
+
+func TestWriterProtocol(t *testing.T) {
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.WriteNull()
+	w.WriteMapHeader(1)
+	w.WritePushHeader(2)
+	w.Flush()
+	assert.Equal("$-1\r\n*2\r\n*2\r\n", buf.String())
+
+	buf.Reset()
+	w.SetProtocol(RESP3)
+	w.WriteNull()
+	w.WriteMapHeader(1)
+	w.WritePushHeader(2)
+	w.Flush()
+	assert.Equal("_\r\n%1\r\n>2\r\n", buf.String())
+}
+
+func TestKeySlot(t *testing.T) {
+	assert := assert.New(t)
+
+	// the check value of CRC-16/XMODEM
+	assert.Equal(uint16(0x31c3), crc16("123456789"))
+
+	// slots reported by CLUSTER KEYSLOT
+	assert.Equal(12182, KeySlot("foo"))
+	assert.Equal(5061, KeySlot("bar"))
+	assert.Equal(866, KeySlot("hello"))
+
+	// only hash tags are hashed
+	assert.Equal(KeySlot("user:42"), KeySlot("{user:42}:profile"))
+	assert.Equal(KeySlot("{user:42}:profile"), KeySlot("{user:42}:settings"))
+	assert.Equal(KeySlot("bar"), KeySlot("foo{bar}{zap}"))
+	assert.Equal(KeySlot("{bar"), KeySlot("foo{{bar}}zap"))
+	// empty tags are not
+	assert.NotEqual(KeySlot("bar"), KeySlot("foo{}{bar}"))
+	assert.Equal(int(crc16("foo{}{bar}")%Slots), KeySlot("foo{}{bar}"))
+}
@@ -0,0 +1,113 @@
+package resptest
+
+import (
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/cat-turner/proxy/resp"
+)
+
+// Cluster is a Redis Cluster of Servers. Each server owns some of the hash
+// slots and answers MOVED for keys in the others, and pub/sub messages reach
+// subscribers on every server.
+type Cluster struct {
+	Servers []*Server
+
+	mux sync.Mutex
+	// owners is the index of the server owning each slot
+	owners []int
+}
+
+// NewCluster starts a Cluster of n servers with the slots split evenly
+// between them
+func NewCluster(n int) *Cluster {
+	c := &Cluster{owners: make([]int, resp.Slots)}
+	for slot := range c.owners {
+		c.owners[slot] = slot * n / resp.Slots
+	}
+	for i := 0; i < n; i++ {
+		c.Servers = append(c.Servers, newServer(c))
+	}
+	return c
+}
+
+// Addrs returns the address of every server, any of them can be used to
+// find the others
+func (c *Cluster) Addrs() []string {
+	addrs := make([]string, len(c.Servers))
+	for i, s := range c.Servers {
+		addrs[i] = s.Addr()
+	}
+	return addrs
+}
+
+// MoveSlot hands slot and its keys over to Servers[to], like resharding
+// does. Clients that still send the slot's keys to the old owner get MOVED.
+func (c *Cluster) MoveSlot(slot int, to int) {
+	c.mux.Lock()
+	from := c.Servers[c.owners[slot]]
+	c.owners[slot] = to
+	c.mux.Unlock()
+	dst := c.Servers[to]
+	if from == dst {
+		return
+	}
+
+	moved := make(map[string]entry)
+	from.mux.Lock()
+	for key, e := range from.values {
+		if resp.KeySlot(key) == slot {
+			moved[key] = e
+			delete(from.values, key)
+		}
+	}
+	from.mux.Unlock()
+	dst.mux.Lock()
+	for key, e := range moved {
+		dst.values[key] = e
+	}
+	dst.mux.Unlock()
+}
+
+// Close stops every server
+func (c *Cluster) Close() {
+	for _, s := range c.Servers {
+		s.Close()
+	}
+}
+
+func (c *Cluster) owner(slot int) *Server {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.Servers[c.owners[slot]]
+}
+
+// writeSlots writes the reply to CLUSTER SLOTS, a range for each run of
+// slots owned by the same server
+func (c *Cluster) writeSlots(w *resp.Writer) {
+	type slotRange struct{ start, end, owner int }
+	var ranges []slotRange
+	c.mux.Lock()
+	for slot, owner := range c.owners {
+		if n := len(ranges); n > 0 && ranges[n-1].owner == owner && ranges[n-1].end == slot-1 {
+			ranges[n-1].end = slot
+		} else {
+			ranges = append(ranges, slotRange{slot, slot, owner})
+		}
+	}
+	c.mux.Unlock()
+
+	w.WriteArrayHeader(len(ranges))
+	for _, r := range ranges {
+		host, port, _ := net.SplitHostPort(c.Servers[r.owner].Addr())
+		p, _ := strconv.ParseInt(port, 10, 64)
+		w.WriteArrayHeader(3)
+		w.WriteInteger(int64(r.start))
+		w.WriteInteger(int64(r.end))
+		w.WriteArrayHeader(3)
+		w.WriteBulkString(host)
+		w.WriteInteger(p)
+		w.WriteBulkString("node" + strconv.Itoa(r.owner))
+	}
+}
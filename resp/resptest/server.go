@@ -0,0 +1,544 @@
+// Package resptest provides a small RESP server for tests, so code that talks
+// to redis can be tested without running redis. It keeps its keys in memory
+// and understands PING, GET, SET, MGET, DEL, EXISTS, PEXPIRE, PTTL, PUBLISH,
+// SUBSCRIBE, UNSUBSCRIBE, MULTI, EXEC and DISCARD, with the same replies redis
+// gives. Servers can also be started as a Redis Cluster with NewCluster.
+package resptest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cat-turner/proxy/resp"
+)
+
+// Server is a RESP server listening on a loopback port
+type Server struct {
+	l net.Listener
+
+	mux    sync.Mutex
+	values map[string]entry
+	// subscribers are the connections subscribed to each channel
+	subscribers map[string]map[*conn]bool
+	conns       map[*conn]bool
+	closed      bool
+	// cluster is the cluster the server is a node of, nil if it is not
+	cluster *Cluster
+
+	wg sync.WaitGroup
+}
+
+type entry struct {
+	value string
+	// expires is zero when the key does not expire
+	expires time.Time
+}
+
+// conn is a client connection. Pub/sub messages are sent to it from other
+// connections, so sends are guarded by a lock.
+type conn struct {
+	net.Conn
+	mux sync.Mutex
+	// buf and w build the replies to the connection's own commands
+	buf      bytes.Buffer
+	w        *resp.Writer
+	channels map[string]bool
+
+	// multi is set between MULTI and EXEC, the commands in between are
+	// queued and aborted is set if one of them could not be
+	multi   bool
+	aborted bool
+	queued  [][]string
+}
+
+// NewServer starts a Server on a random loopback port. It panics if it can
+// not listen, like httptest.NewServer.
+func NewServer() *Server {
+	return newServer(nil)
+}
+
+func newServer(cluster *Cluster) *Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("resptest: failed to listen: %v", err))
+	}
+	s := &Server{
+		l:           l,
+		values:      make(map[string]entry),
+		subscribers: make(map[string]map[*conn]bool),
+		conns:       make(map[*conn]bool),
+		cluster:     cluster,
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+// Addr returns the address clients connect to, like 127.0.0.1:54321
+func (s *Server) Addr() string {
+	return s.l.Addr().String()
+}
+
+// Close stops the server and disconnects every client
+func (s *Server) Close() {
+	s.mux.Lock()
+	s.closed = true
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mux.Unlock()
+	s.l.Close()
+	s.wg.Wait()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		nc, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		c := &conn{Conn: nc, channels: make(map[string]bool)}
+		c.w = resp.NewWriter(&c.buf)
+		s.mux.Lock()
+		if s.closed {
+			s.mux.Unlock()
+			nc.Close()
+			return
+		}
+		s.conns[c] = true
+		s.mux.Unlock()
+		s.wg.Add(1)
+		go s.serveConn(c)
+	}
+}
+
+func (s *Server) serveConn(c *conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mux.Lock()
+		for channel := range c.channels {
+			delete(s.subscribers[channel], c)
+		}
+		delete(s.conns, c)
+		s.mux.Unlock()
+		c.Close()
+	}()
+
+	r := resp.NewReader(c)
+	for {
+		args, err := r.ReadCommand()
+		if err != nil {
+			if err != io.EOF {
+				c.reply(func(w *resp.Writer) { w.WriteError("ERR " + err.Error()) })
+			}
+			return
+		}
+		name := strings.ToUpper(args[0])
+		c.reply(func(w *resp.Writer) { s.dispatch(w, c, name, args[1:]) })
+		if name == "QUIT" {
+			return
+		}
+	}
+}
+
+// reply sends whatever f writes to the client in one go
+func (c *conn) reply(f func(w *resp.Writer)) {
+	c.buf.Reset()
+	f(c.w)
+	c.w.Flush()
+	c.send(c.buf.Bytes())
+}
+
+func (c *conn) send(b []byte) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.Write(b)
+}
+
+// dispatch runs a single command and writes its reply
+func (s *Server) dispatch(w *resp.Writer, c *conn, name string, args []string) {
+	if len(c.channels) > 0 {
+		// like redis, a subscribed client can only manage its
+		// subscriptions
+		switch name {
+		case "SUBSCRIBE", "UNSUBSCRIBE", "PING", "QUIT":
+		default:
+			w.WriteError(fmt.Sprintf("ERR Can't execute '%v': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context", strings.ToLower(name)))
+			return
+		}
+	}
+
+	if c.multi {
+		switch name {
+		case "MULTI", "EXEC", "DISCARD":
+		case "PUBLISH", "SUBSCRIBE", "UNSUBSCRIBE":
+			c.aborted = true
+			w.WriteError(fmt.Sprintf("ERR '%v' inside MULTI is not supported", strings.ToLower(name)))
+			return
+		default:
+			if err := s.checkKeys(name, args); err != "" {
+				c.aborted = true
+				w.WriteError(err)
+				return
+			}
+			c.queued = append(c.queued, append([]string{name}, args...))
+			w.WriteSimpleString("QUEUED")
+			return
+		}
+	}
+	if err := s.checkKeys(name, args); err != "" {
+		w.WriteError(err)
+		return
+	}
+
+	switch name {
+	case "MULTI":
+		if c.multi {
+			w.WriteError("ERR MULTI calls can not be nested")
+			return
+		}
+		c.multi = true
+		w.WriteSimpleString("OK")
+	case "DISCARD", "EXEC":
+		if !c.multi {
+			w.WriteError(fmt.Sprintf("ERR %v without MULTI", name))
+			return
+		}
+		queued, aborted := c.queued, c.aborted
+		c.multi, c.aborted, c.queued = false, false, nil
+		if name == "DISCARD" {
+			w.WriteSimpleString("OK")
+			return
+		}
+		if aborted {
+			w.WriteError("EXECABORT Transaction discarded because of previous errors.")
+			return
+		}
+		// the queued commands run without anything in between
+		s.mux.Lock()
+		defer s.mux.Unlock()
+		now := time.Now()
+		w.WriteArrayHeader(len(queued))
+		for _, args := range queued {
+			s.run(w, c, args[0], args[1:], now)
+		}
+	case "PUBLISH":
+		if len(args) != 2 {
+			wrongArgs(w, name)
+			return
+		}
+		w.WriteInteger(int64(s.publish(args[0], args[1])))
+	case "COMMAND":
+		writeCommandInfo(w)
+	case "CLUSTER":
+		if len(args) != 1 || strings.ToUpper(args[0]) != "SLOTS" {
+			w.WriteError("ERR unknown subcommand, only CLUSTER SLOTS is supported")
+			return
+		}
+		if s.cluster == nil {
+			w.WriteError("ERR This instance has cluster support disabled")
+			return
+		}
+		s.cluster.writeSlots(w)
+	default:
+		s.mux.Lock()
+		defer s.mux.Unlock()
+		s.run(w, c, name, args, time.Now())
+	}
+}
+
+// run runs a command that works with the keys or subscriptions and writes
+// its reply, the lock must be held
+func (s *Server) run(w *resp.Writer, c *conn, name string, args []string, now time.Time) {
+	switch name {
+	case "PING":
+		if len(c.channels) > 0 {
+			message := ""
+			if len(args) > 0 {
+				message = args[0]
+			}
+			w.WriteArrayHeader(2)
+			w.WriteBulkString("pong")
+			w.WriteBulkString(message)
+		} else if len(args) > 0 {
+			w.WriteBulkString(args[0])
+		} else {
+			w.WriteSimpleString("PONG")
+		}
+	case "QUIT":
+		w.WriteSimpleString("OK")
+	case "GET":
+		if len(args) != 1 {
+			wrongArgs(w, name)
+			return
+		}
+		e, ok := s.get(args[0], now)
+		if !ok {
+			w.WriteNull()
+			return
+		}
+		w.WriteBulkString(e.value)
+	case "MGET":
+		if len(args) < 1 {
+			wrongArgs(w, name)
+			return
+		}
+		w.WriteArrayHeader(len(args))
+		for _, key := range args {
+			if e, ok := s.get(key, now); ok {
+				w.WriteBulkString(e.value)
+			} else {
+				w.WriteNull()
+			}
+		}
+	case "SET":
+		if len(args) < 2 {
+			wrongArgs(w, name)
+			return
+		}
+		e := entry{value: args[1]}
+		for opts := args[2:]; len(opts) > 0; opts = opts[2:] {
+			option := strings.ToUpper(opts[0])
+			if (option != "EX" && option != "PX") || len(opts) < 2 {
+				w.WriteError("ERR syntax error")
+				return
+			}
+			n, err := strconv.ParseInt(opts[1], 10, 64)
+			if err != nil {
+				w.WriteError("ERR value is not an integer or out of range")
+				return
+			}
+			if n <= 0 {
+				w.WriteError("ERR invalid expire time in 'set' command")
+				return
+			}
+			unit := time.Millisecond
+			if option == "EX" {
+				unit = time.Second
+			}
+			e.expires = now.Add(time.Duration(n) * unit)
+		}
+		s.values[args[0]] = e
+		w.WriteSimpleString("OK")
+	case "DEL", "EXISTS":
+		if len(args) < 1 {
+			wrongArgs(w, name)
+			return
+		}
+		var n int64
+		for _, key := range args {
+			if _, ok := s.get(key, now); ok {
+				n++
+				if name == "DEL" {
+					delete(s.values, key)
+				}
+			}
+		}
+		w.WriteInteger(n)
+	case "PEXPIRE":
+		if len(args) != 2 {
+			wrongArgs(w, name)
+			return
+		}
+		ms, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			w.WriteError("ERR value is not an integer or out of range")
+			return
+		}
+		e, ok := s.get(args[0], now)
+		if !ok {
+			w.WriteInteger(0)
+			return
+		}
+		if ms <= 0 {
+			delete(s.values, args[0])
+		} else {
+			e.expires = now.Add(time.Duration(ms) * time.Millisecond)
+			s.values[args[0]] = e
+		}
+		w.WriteInteger(1)
+	case "PTTL":
+		if len(args) != 1 {
+			wrongArgs(w, name)
+			return
+		}
+		e, ok := s.get(args[0], now)
+		switch {
+		case !ok:
+			w.WriteInteger(-2)
+		case e.expires.IsZero():
+			w.WriteInteger(-1)
+		default:
+			w.WriteInteger(int64(e.expires.Sub(now) / time.Millisecond))
+		}
+	case "SUBSCRIBE":
+		if len(args) < 1 {
+			wrongArgs(w, name)
+			return
+		}
+		for _, channel := range args {
+			if s.subscribers[channel] == nil {
+				s.subscribers[channel] = make(map[*conn]bool)
+			}
+			s.subscribers[channel][c] = true
+			c.channels[channel] = true
+			writeSubscription(w, "subscribe", channel, len(c.channels))
+		}
+		// the confirmation goes out before anyone can publish to us
+		w.Flush()
+		c.send(c.buf.Bytes())
+		c.buf.Reset()
+	case "UNSUBSCRIBE":
+		channels := args
+		if len(channels) == 0 {
+			for channel := range c.channels {
+				channels = append(channels, channel)
+			}
+		}
+		if len(channels) == 0 {
+			w.WriteArrayHeader(3)
+			w.WriteBulkString("unsubscribe")
+			w.WriteNull()
+			w.WriteInteger(0)
+			return
+		}
+		for _, channel := range channels {
+			delete(s.subscribers[channel], c)
+			delete(c.channels, channel)
+			writeSubscription(w, "unsubscribe", channel, len(c.channels))
+		}
+	default:
+		w.WriteError(fmt.Sprintf("ERR unknown command '%v'", name))
+	}
+}
+
+// publish sends message to the clients subscribed to channel and returns how
+// many there were. In a cluster they can be connected to any server. The
+// messages are sent before the reply to PUBLISH, so a client that publishes
+// twice has them arrive in order.
+func (s *Server) publish(channel string, message string) int {
+	var b bytes.Buffer
+	w := resp.NewWriter(&b)
+	w.WriteArrayHeader(3)
+	w.WriteBulkString("message")
+	w.WriteBulkString(channel)
+	w.WriteBulkString(message)
+	w.Flush()
+
+	servers := []*Server{s}
+	if s.cluster != nil {
+		servers = s.cluster.Servers
+	}
+	n := 0
+	for _, srv := range servers {
+		srv.mux.Lock()
+		var receivers []*conn
+		for r := range srv.subscribers[channel] {
+			receivers = append(receivers, r)
+		}
+		srv.mux.Unlock()
+		for _, r := range receivers {
+			r.send(b.Bytes())
+		}
+		n += len(receivers)
+	}
+	return n
+}
+
+// checkKeys returns the error for a command whose keys this server does not
+// serve, "" if it can run here. Only cluster nodes turn commands away.
+func (s *Server) checkKeys(name string, args []string) string {
+	if s.cluster == nil {
+		return ""
+	}
+	var keys []string
+	switch name {
+	case "GET", "SET", "PEXPIRE", "PTTL":
+		if len(args) > 0 {
+			keys = args[:1]
+		}
+	case "MGET", "DEL", "EXISTS":
+		keys = args
+	}
+	if len(keys) == 0 {
+		return ""
+	}
+	slot := resp.KeySlot(keys[0])
+	for _, key := range keys[1:] {
+		if resp.KeySlot(key) != slot {
+			return "CROSSSLOT Keys in request don't hash to the same slot"
+		}
+	}
+	if owner := s.cluster.owner(slot); owner != s {
+		return fmt.Sprintf("MOVED %d %s", slot, owner.Addr())
+	}
+	return ""
+}
+
+// get returns the entry for key unless it has expired, the lock must be held
+func (s *Server) get(key string, now time.Time) (entry, bool) {
+	e, ok := s.values[key]
+	if ok && !e.expires.IsZero() && !now.Before(e.expires) {
+		delete(s.values, key)
+		return entry{}, false
+	}
+	return e, ok
+}
+
+func writeSubscription(w *resp.Writer, kind string, channel string, count int) {
+	w.WriteArrayHeader(3)
+	w.WriteBulkString(kind)
+	w.WriteBulkString(channel)
+	w.WriteInteger(int64(count))
+}
+
+// commands describes the commands for COMMAND, which cluster clients use to
+// find the keys of a command: name, arity, flags, first key, last key, step
+var commands = []struct {
+	name                    string
+	arity                   int64
+	flag                    string
+	firstKey, lastKey, step int64
+}{
+	{"ping", -1, "stale", 0, 0, 0},
+	{"get", 2, "readonly", 1, 1, 1},
+	{"mget", -2, "readonly", 1, -1, 1},
+	{"set", -3, "write", 1, 1, 1},
+	{"del", -2, "write", 1, -1, 1},
+	{"exists", -2, "readonly", 1, -1, 1},
+	{"pexpire", 3, "write", 1, 1, 1},
+	{"pttl", 2, "readonly", 1, 1, 1},
+	{"publish", 3, "pubsub", 0, 0, 0},
+	{"subscribe", -2, "pubsub", 0, 0, 0},
+	{"unsubscribe", -1, "pubsub", 0, 0, 0},
+	{"multi", 1, "fast", 0, 0, 0},
+	{"exec", 1, "skip_monitor", 0, 0, 0},
+	{"discard", 1, "fast", 0, 0, 0},
+	{"command", -1, "random", 0, 0, 0},
+	{"cluster", -2, "admin", 0, 0, 0},
+}
+
+func writeCommandInfo(w *resp.Writer) {
+	w.WriteArrayHeader(len(commands))
+	for _, cmd := range commands {
+		w.WriteArrayHeader(6)
+		w.WriteBulkString(cmd.name)
+		w.WriteInteger(cmd.arity)
+		w.WriteArrayHeader(1)
+		w.WriteSimpleString(cmd.flag)
+		w.WriteInteger(cmd.firstKey)
+		w.WriteInteger(cmd.lastKey)
+		w.WriteInteger(cmd.step)
+	}
+}
+
+func wrongArgs(w *resp.Writer, name string) {
+	w.WriteError(fmt.Sprintf("ERR wrong number of arguments for '%v' command", strings.ToLower(name)))
+}
@@ -0,0 +1,206 @@
+package resptest
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cat-turner/proxy/resp"
+	redis "github.com/go-redis/redis/v8"
+	assert "github.com/stretchr/testify/assert"
+)
+
+func TestServer(t *testing.T) {
+	assert := assert.New(t)
+
+	s := NewServer()
+	defer s.Close()
+
+	var ctx = context.Background()
+	client := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	defer client.Close()
+
+	pong, err := client.Ping(ctx).Result()
+	assert.NoError(err)
+	assert.Equal("PONG", pong)
+
+	_, err = client.Get(ctx, "roxi").Result()
+	assert.Equal(redis.Nil, err)
+	err = client.Set(ctx, "roxi", "rocks", 0).Err()
+	assert.NoError(err)
+	value, err := client.Get(ctx, "roxi").Result()
+	assert.NoError(err)
+	assert.Equal("rocks", value)
+
+	ttl, err := client.PTTL(ctx, "roxi").Result()
+	assert.NoError(err)
+	assert.Equal(time.Duration(-1), ttl)
+	ok, err := client.PExpire(ctx, "roxi", time.Hour).Result()
+	assert.NoError(err)
+	assert.True(ok)
+	ttl, err = client.PTTL(ctx, "roxi").Result()
+	assert.NoError(err)
+	assert.InDelta(time.Hour, ttl, float64(time.Second))
+
+	err = client.Set(ctx, "tita", "is cool", 20*time.Millisecond).Err()
+	assert.NoError(err)
+	values, err := client.MGet(ctx, "roxi", "nobody", "tita").Result()
+	assert.NoError(err)
+	assert.Equal([]interface{}{"rocks", nil, "is cool"}, values)
+
+	// keys expire
+	time.Sleep(30 * time.Millisecond)
+	n, err := client.Exists(ctx, "roxi", "tita").Result()
+	assert.NoError(err)
+	assert.Equal(int64(1), n)
+	ttl, err = client.PTTL(ctx, "tita").Result()
+	assert.NoError(err)
+	assert.Equal(time.Duration(-2), ttl)
+
+	n, err = client.Del(ctx, "roxi", "tita").Result()
+	assert.NoError(err)
+	assert.Equal(int64(1), n)
+
+	err = client.Do(ctx, "SET", "roxi", "rocks", "KEEPTTL").Err()
+	assert.EqualError(err, "ERR syntax error")
+	err = client.Do(ctx, "NOPE").Err()
+	assert.EqualError(err, "ERR unknown command 'NOPE'")
+}
+
+func TestServerPubSub(t *testing.T) {
+	assert := assert.New(t)
+
+	s := NewServer()
+	defer s.Close()
+
+	var ctx = context.Background()
+	client := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	defer client.Close()
+
+	pubsub := client.Subscribe(ctx, "news")
+	defer pubsub.Close()
+	_, err := pubsub.Receive(ctx)
+	assert.NoError(err)
+
+	n, err := client.Publish(ctx, "news", "roxi rocks").Result()
+	assert.NoError(err)
+	assert.Equal(int64(1), n)
+	n, err = client.Publish(ctx, "olds", "tita is fire").Result()
+	assert.NoError(err)
+	assert.Equal(int64(0), n)
+	client.Publish(ctx, "news", "roxi still rocks")
+
+	for _, want := range []string{"roxi rocks", "roxi still rocks"} {
+		select {
+		case msg := <-pubsub.Channel():
+			assert.Equal("news", msg.Channel)
+			assert.Equal(want, msg.Payload)
+		case <-time.After(time.Second):
+			t.Fatal("no message")
+		}
+	}
+
+	err = pubsub.Unsubscribe(ctx, "news")
+	assert.NoError(err)
+	// the publish goes over another connection, so give the server a
+	// moment to handle the unsubscribe first
+	time.Sleep(20 * time.Millisecond)
+	n, err = client.Publish(ctx, "news", "nobody listens").Result()
+	assert.NoError(err)
+	assert.Equal(int64(0), n)
+}
+
+func TestServerTransaction(t *testing.T) {
+	assert := assert.New(t)
+
+	s := NewServer()
+	defer s.Close()
+
+	var ctx = context.Background()
+	client := redis.NewClient(&redis.Options{Addr: s.Addr()})
+	defer client.Close()
+
+	cmds, err := client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, "roxi", "rocks", 0)
+		pipe.Get(ctx, "roxi")
+		return nil
+	})
+	assert.NoError(err)
+	assert.Equal("rocks", cmds[1].(*redis.StringCmd).Val())
+
+	// a command that can not be queued discards the whole transaction
+	_, err = client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, "tita", "is fire", 0)
+		pipe.Publish(ctx, "news", "roxi rocks")
+		return nil
+	})
+	assert.EqualError(err, "EXECABORT Transaction discarded because of previous errors.")
+	_, err = client.Get(ctx, "tita").Result()
+	assert.Equal(redis.Nil, err)
+}
+
+func TestCluster(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewCluster(3)
+	defer c.Close()
+
+	var ctx = context.Background()
+	client := redis.NewClusterClient(&redis.ClusterOptions{Addrs: c.Addrs()[:1]})
+	defer client.Close()
+
+	// the keys are spread over the servers and the client finds them
+	keys := []string{"roxi", "tita", "pip", "merry"}
+	for _, key := range keys {
+		err := client.Set(ctx, key, key+" rocks", 0).Err()
+		assert.NoError(err)
+	}
+	for _, key := range keys {
+		value, err := client.Get(ctx, key).Result()
+		assert.NoError(err)
+		assert.Equal(key+" rocks", value)
+	}
+
+	// servers only take the keys of their own slots, in a single slot
+	var servers []*redis.Client
+	for _, s := range c.Servers {
+		server := redis.NewClient(&redis.Options{Addr: s.Addr()})
+		defer server.Close()
+		servers = append(servers, server)
+	}
+	slot := resp.KeySlot("roxi")
+	owner := slot * 3 / resp.Slots
+	err := servers[(owner+1)%3].Get(ctx, "roxi").Err()
+	assert.EqualError(err, fmt.Sprintf("MOVED %d %s", slot, c.Servers[owner].Addr()))
+	err = servers[0].MGet(ctx, "roxi", "tita").Err()
+	assert.EqualError(err, "CROSSSLOT Keys in request don't hash to the same slot")
+	values, err := client.MGet(ctx, "{user}:roxi", "{user}:tita").Result()
+	assert.NoError(err)
+	assert.Equal([]interface{}{nil, nil}, values)
+
+	// keys follow their slot when it moves
+	c.MoveSlot(slot, (owner+1)%3)
+	value, err := client.Get(ctx, "roxi").Result()
+	assert.NoError(err)
+	assert.Equal("roxi rocks", value)
+
+	// messages reach subscribers on any server
+	pubsub := client.Subscribe(ctx, "news")
+	defer pubsub.Close()
+	_, err = pubsub.Receive(ctx)
+	assert.NoError(err)
+	for _, server := range servers {
+		n, err := server.Publish(ctx, "news", "roxi rocks").Result()
+		assert.NoError(err)
+		assert.Equal(int64(1), n)
+	}
+	for range servers {
+		select {
+		case msg := <-pubsub.Channel():
+			assert.Equal("roxi rocks", msg.Payload)
+		case <-time.After(time.Second):
+			t.Fatal("no message")
+		}
+	}
+}
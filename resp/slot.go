@@ -0,0 +1,35 @@
+package resp
+
+import "strings"
+
+// Slots is the number of hash slots the keys of a Redis Cluster are split
+// into
+const Slots = 16384
+
+// KeySlot returns the hash slot of key in a Redis Cluster. When the key has a
+// non-empty hash tag, like {user:42} in {user:42}:profile, only the tag is
+// hashed, so keys with the same tag always share a slot.
+func KeySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) % Slots)
+}
+
+// crc16 is the CRC-16/XMODEM checksum redis uses for hash slots
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
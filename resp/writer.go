@@ -0,0 +1,131 @@
+package resp
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+)
+
+// Writer writes RESP values to a buffered stream. Nothing is sent to the
+// peer until Flush is called.
+//
+// Writers speak RESP2 unless SetProtocol says otherwise. Types that only
+// exist in RESP3 are written as their closest RESP2 equivalent, the same way
+// redis does it.
+type Writer struct {
+	wr    *bufio.Writer
+	proto int
+}
+
+// NewWriter creates a Writer that buffers w
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{wr: bufio.NewWriter(w), proto: RESP2}
+}
+
+// SetProtocol switches the writer to the given protocol version
+func (w *Writer) SetProtocol(proto int) {
+	w.proto = proto
+}
+
+// Protocol returns the protocol version the writer speaks
+func (w *Writer) Protocol() int {
+	return w.proto
+}
+
+// WriteSimpleString writes a status reply like OK or PONG
+func (w *Writer) WriteSimpleString(s string) error {
+	return w.writeLine(SimpleString, s)
+}
+
+// WriteError writes an error reply. By convention msg starts with an error
+// code like ERR or WRONGTYPE.
+func (w *Writer) WriteError(msg string) error {
+	return w.writeLine(Error, msg)
+}
+
+// WriteInteger writes an integer reply
+func (w *Writer) WriteInteger(n int64) error {
+	return w.writeLine(Integer, strconv.FormatInt(n, 10))
+}
+
+// WriteBulkString writes a binary safe string
+func (w *Writer) WriteBulkString(s string) error {
+	if err := w.writeLine(BulkString, strconv.Itoa(len(s))); err != nil {
+		return err
+	}
+	if _, err := w.wr.WriteString(s); err != nil {
+		return err
+	}
+	_, err := w.wr.WriteString("\r\n")
+	return err
+}
+
+// WriteNull writes a null, which is what clients expect for missing keys.
+// RESP2 clients get a null bulk string.
+func (w *Writer) WriteNull() error {
+	if w.proto == RESP3 {
+		return w.writeLine(Null, "")
+	}
+	return w.writeLine(BulkString, "-1")
+}
+
+// WriteArrayHeader starts an array of n elements. The caller writes the
+// elements afterwards.
+func (w *Writer) WriteArrayHeader(n int) error {
+	return w.writeLine(Array, strconv.Itoa(n))
+}
+
+// WriteMapHeader starts a map of n key value pairs. The caller writes each
+// key followed by its value. RESP2 clients get an array of 2n elements.
+func (w *Writer) WriteMapHeader(n int) error {
+	if w.proto == RESP3 {
+		return w.writeLine(Map, strconv.Itoa(n))
+	}
+	return w.WriteArrayHeader(2 * n)
+}
+
+// WritePushHeader starts an out of band push of n elements, like an
+// invalidation message. RESP2 clients get a plain array, which is how pub/sub
+// messages look in RESP2.
+func (w *Writer) WritePushHeader(n int) error {
+	if w.proto == RESP3 {
+		return w.writeLine(Push, strconv.Itoa(n))
+	}
+	return w.WriteArrayHeader(n)
+}
+
+// WriteCommand writes args as an array of bulk strings, the form servers
+// expect commands in
+func (w *Writer) WriteCommand(args ...string) error {
+	if err := w.WriteArrayHeader(len(args)); err != nil {
+		return err
+	}
+	for _, a := range args {
+		if err := w.WriteBulkString(a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flush sends any buffered data to the underlying stream
+func (w *Writer) Flush() error {
+	return w.wr.Flush()
+}
+
+func (w *Writer) writeLine(prefix byte, s string) error {
+	if err := w.wr.WriteByte(prefix); err != nil {
+		return err
+	}
+	if _, err := w.wr.WriteString(s); err != nil {
+		return err
+	}
+	_, err := w.wr.WriteString("\r\n")
+	return err
+}
+
+// Reset discards any unflushed data and makes w write to dst, which lets
+// callers reuse writers across many replies
+func (w *Writer) Reset(dst io.Writer) {
+	w.wr.Reset(dst)
+}